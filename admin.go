@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The endpoints next to /metrics and /probe are unauthenticated and usually
+// reachable by anything that can reach Prometheus, so the admin endpoint is
+// never served with them. It gets a listener of its own, which should be
+// bound where only operators can reach it, and requires HTTP basic auth.
+var (
+	adminListenAddress = flag.String("admin.listen-address", "", "If set, serve POST /admin/reset on this address, which flushes cached gateway data, closes tripped circuits, clears failure counts and drops gateway sessions, for recovering from transient problems without a restart. Requires -admin.basic-auth-file. Use a loopback address or a unix:/path socket only operators can reach. It must differ from every other listen address.")
+	adminBasicAuthFile = flag.String("admin.basic-auth-file", "", "File holding username:password on one line. Requests to -admin.listen-address must send these as HTTP basic auth. Required with -admin.listen-address.")
+)
+
+// adminResetPath is where the reset endpoint is served on
+// -admin.listen-address.
+const adminResetPath = "/admin/reset"
+
+// validateAdminAddress checks that -admin.listen-address doesn't share a
+// listener with the unauthenticated endpoints and has credentials, and
+// warns if it is reachable from other hosts.
+func validateAdminAddress() error {
+	addr := *adminListenAddress
+	if addr == "" {
+		if *adminBasicAuthFile != "" {
+			return errors.New("-admin.basic-auth-file has no effect without -admin.listen-address")
+		}
+		return nil
+	}
+	if *adminBasicAuthFile == "" {
+		return errors.New("-admin.listen-address requires -admin.basic-auth-file")
+	}
+	for flagName, other := range map[string]string{
+		"-web.listen-address":       *listenAddress,
+		"-web.probe-listen-address": *probeListenAddress,
+		"-web.unix-socket":          unixAddressPrefix + *unixSocket,
+	} {
+		if other != "" && other != unixAddressPrefix && addr == other {
+			return errors.Errorf("-admin.listen-address must differ from %s, got %q for both", flagName, addr)
+		}
+	}
+
+	if strings.HasPrefix(addr, unixAddressPrefix) {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrap(err, "parsing -admin.listen-address")
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		slog.Warn("-admin.listen-address is not a loopback address: admin credentials will cross the network unencrypted", "address", addr)
+	}
+	return nil
+}
+
+// adminCredentials are the basic auth credentials for -admin.listen-address.
+type adminCredentials struct {
+	username string
+	password string
+}
+
+// loadAdminCredentials reads the credentials in -admin.basic-auth-file.
+func loadAdminCredentials() (adminCredentials, error) {
+	data, err := ioutil.ReadFile(*adminBasicAuthFile)
+	if err != nil {
+		return adminCredentials{}, errors.Wrap(err, "reading -admin.basic-auth-file")
+	}
+	username, password, ok := strings.Cut(strings.TrimRight(string(data), "\r\n"), ":")
+	if !ok || username == "" || password == "" {
+		return adminCredentials{}, errors.Errorf("%s must hold username:password on one line", *adminBasicAuthFile)
+	}
+	return adminCredentials{username: username, password: password}, nil
+}
+
+// match reports whether username and password are c. Hashes of equal
+// length are compared in constant time, so how long it takes gives nothing
+// away about either.
+func (c adminCredentials) match(username, password string) bool {
+	wantUser, wantPassword := sha256.Sum256([]byte(c.username)), sha256.Sum256([]byte(c.password))
+	gotUser, gotPassword := sha256.Sum256([]byte(username)), sha256.Sum256([]byte(password))
+	userOK := subtle.ConstantTimeCompare(gotUser[:], wantUser[:]) == 1
+	passwordOK := subtle.ConstantTimeCompare(gotPassword[:], wantPassword[:]) == 1
+	return userOK && passwordOK
+}
+
+// newAdminMux returns the handler for -admin.listen-address, which turns
+// away requests that don't carry creds.
+func newAdminMux(creds adminCredentials) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminResetPath, adminResetHandler)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || !creds.match(username, password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="powerwall-exporter admin", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// resetSummary is what /admin/reset reports it cleared. Each count is the
+// number of targets or entries that had something to reset.
+type resetSummary struct {
+	CachedCollections   int `json:"cached_collections"`
+	SiteInfo            int `json:"site_info"`
+	Capabilities        int `json:"capabilities"`
+	CloudComparisons    int `json:"cloud_comparisons"`
+	HeldResults         int `json:"held_results"`
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	Circuits            int `json:"circuits"`
+	Sessions            int `json:"sessions"`
+}
+
+// adminResetHandler resets the exporter's state about every target so the
+// next scrape starts afresh, and replies with a summary of what it reset.
+func adminResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Use POST to reset exporter state.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	summary := resetState(time.Now())
+	slog.InfoContext(r.Context(), "Reset exporter state", "remote", r.RemoteAddr, "summary", summary)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		slog.Error("Writing reset summary failed", "error", err)
+	}
+}
+
+// resetState flushes cached gateway data, clears failure counts, closes
+// every tripped circuit and drops every gateway session, so the next
+// scrape queries everything and logs in again.
+func resetState(now time.Time) resetSummary {
+	var summary resetSummary
+
+	statesMu.Lock()
+	targets := make([]*targetState, 0, len(states))
+	for _, s := range states {
+		targets = append(targets, s)
+	}
+	statesMu.Unlock()
+
+	for _, s := range targets {
+		s.mu.Lock()
+		if len(s.slowCollections) > 0 {
+			summary.CachedCollections += len(s.slowCollections)
+			s.slowCollections = nil
+		}
+		if s.siteInfo != nil {
+			summary.SiteInfo++
+			s.siteInfo, s.siteInfoTime = nil, time.Time{}
+		}
+		if s.capabilities != nil {
+			summary.Capabilities++
+			s.capabilities = nil
+		}
+		if s.cloudComparison != nil {
+			summary.CloudComparisons++
+			s.cloudComparison = nil
+		}
+		if s.consecutiveFailures > 0 {
+			summary.ConsecutiveFailures++
+		}
+		s.consecutiveFailures, s.consecutiveSuccesses = 0, 0
+		s.mu.Unlock()
+	}
+
+	if scraper != nil {
+		summary.HeldResults = scraper.dropHeld()
+	}
+
+	limitersMu.Lock()
+	hosts := make([]*hostLimiter, 0, len(limiters))
+	for _, l := range limiters {
+		hosts = append(hosts, l)
+	}
+	limitersMu.Unlock()
+
+	for _, l := range hosts {
+		if l.reset(now) {
+			summary.Circuits++
+		}
+	}
+
+	if jar, ok := httpClient.Jar.(*targetJar); ok {
+		summary.Sessions = jar.reset()
+	}
+
+	return summary
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidateAdminAddress(t *testing.T) {
+	setFlag(t, listenAddress, "0.0.0.0:8080")
+	setFlag(t, probeListenAddress, "192.168.1.10:8080")
+	setFlag(t, unixSocket, "/run/powerwall-exporter/exporter.sock")
+
+	tests := []struct {
+		addr string
+		ok   bool
+	}{
+		{"", true},
+		{"127.0.0.1:9871", true},
+		{"[::1]:9871", true},
+		{"localhost:9871", true},
+		{"unix:/run/powerwall-exporter/admin.sock", true},
+		{"10.0.0.5:9871", true},
+		{"0.0.0.0:8080", false},
+		{"192.168.1.10:8080", false},
+		{"unix:/run/powerwall-exporter/exporter.sock", false},
+		{"localhost", false},
+	}
+	for _, tt := range tests {
+		file := "/etc/powerwall-exporter/admin-auth"
+		if tt.addr == "" {
+			file = ""
+		}
+		setFlag(t, adminListenAddress, tt.addr)
+		setFlag(t, adminBasicAuthFile, file)
+		if err := validateAdminAddress(); (err == nil) != tt.ok {
+			t.Errorf("validateAdminAddress() with %q = %v, want ok %v", tt.addr, err, tt.ok)
+		}
+	}
+
+	// Credentials are required with the address, and useless without it.
+	for _, tt := range []struct{ addr, file string }{
+		{"127.0.0.1:9871", ""},
+		{"", "/etc/powerwall-exporter/admin-auth"},
+	} {
+		setFlag(t, adminListenAddress, tt.addr)
+		setFlag(t, adminBasicAuthFile, tt.file)
+		if err := validateAdminAddress(); err == nil {
+			t.Errorf("validateAdminAddress() with address %q and credentials file %q succeeded, want an error", tt.addr, tt.file)
+		}
+	}
+}
+
+func TestLoadAdminCredentials(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		content string
+		want    adminCredentials
+		ok      bool
+	}{
+		{"operator:secret\n", adminCredentials{"operator", "secret"}, true},
+		{"operator:pass:word", adminCredentials{"operator", "pass:word"}, true},
+		{"operator", adminCredentials{}, false},
+		{":secret", adminCredentials{}, false},
+		{"operator:\n", adminCredentials{}, false},
+	}
+	for i, tt := range tests {
+		file := filepath.Join(dir, fmt.Sprint(i))
+		if err := os.WriteFile(file, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		setFlag(t, adminBasicAuthFile, file)
+		got, err := loadAdminCredentials()
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("loadAdminCredentials() from %q = %+v, %v, want %+v, ok %v", tt.content, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestAdminMux(t *testing.T) {
+	const target = "192.0.2.1"
+	useTestClient(t)
+	t.Cleanup(func() { forgetTarget(target) })
+	state := stateFor(target)
+	state.mu.Lock()
+	state.siteInfo, state.siteInfoTime = &SiteInfo{}, time.Now()
+	state.consecutiveFailures = 3
+	state.mu.Unlock()
+	limiterFor(target).backoff(time.Now(), time.Now().Add(time.Hour))
+
+	mux := newAdminMux(adminCredentials{username: "operator", password: "secret"})
+	request := func(method, path, username, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if username != "" {
+			r.SetBasicAuth(username, password)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, r)
+		return rec
+	}
+
+	for _, creds := range [][2]string{{"", ""}, {"operator", "wrong"}, {"admin", "secret"}} {
+		if rec := request(http.MethodPost, adminResetPath, creds[0], creds[1]); rec.Code != http.StatusUnauthorized {
+			t.Errorf("POST %s as %q/%q answered %d, want 401", adminResetPath, creds[0], creds[1], rec.Code)
+		}
+	}
+	if got := limiterFor(target).circuitState(time.Now()); got == circuitClosed {
+		t.Error("unauthenticated requests reset the circuit")
+	}
+
+	rec := request(http.MethodGet, adminResetPath, "operator", "secret")
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET %s answered %d, want 405", adminResetPath, rec.Code)
+	}
+
+	rec = request(http.MethodPost, adminResetPath, "operator", "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST %s answered %d: %s", adminResetPath, rec.Code, rec.Body.String())
+	}
+	var summary resetSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("decoding reset summary: %v", err)
+	}
+	if summary.SiteInfo < 1 || summary.ConsecutiveFailures < 1 || summary.Circuits < 1 {
+		t.Errorf("reset summary %+v, want site info, failures and a circuit reset", summary)
+	}
+	if got := limiterFor(target).circuitState(time.Now()); got != circuitClosed {
+		t.Errorf("circuit state after reset = %d, want closed", got)
+	}
+
+	// Nothing else is served next to it.
+	for _, path := range []string{"/", "/metrics", "/probe"} {
+		rec = request(http.MethodGet, path, "operator", "secret")
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("admin listener answered %s with %d, want 404", path, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var backupLoadWindow = flag.Duration("backup.load-window", 0, "Estimate how long the batteries would run the home in an outage, from the energy above the backup reserve and the average home load over this window. Needs the system_status collector and background scraping. 0 disables the estimate.")
+
+var (
+	estimatedBackupHoursMetric = defineMetric(metricDef{
+		Name:      "estimated_backup_hours",
+		Type:      "gauge",
+		Unit:      "hours",
+		Help:      "Estimated hours the batteries could run the home in an outage: energy above the backup reserve over the average load in -backup.load-window, with no solar; absent while the average load is zero",
+		Collector: "system_status",
+		Requires:  "-backup.load-window",
+	})
+	backupLoadMetric = defineMetric(metricDef{
+		Name:      "estimated_backup_load_watts",
+		Type:      "gauge",
+		Unit:      "watts",
+		Help:      "Average home load over -backup.load-window that estimated_backup_hours is based on",
+		Collector: "system_status",
+		Requires:  "-backup.load-window",
+	})
+)
+
+// loadSample is one reading of the home load.
+type loadSample struct {
+	time  time.Time
+	watts float64
+}
+
+// recordLoad adds a reading of host's home load, dropping readings that
+// have fallen out of -backup.load-window. Stale readings are left out.
+func recordLoad(host string, load Record, now time.Time) {
+	if *freshnessMaxAge > 0 && sourceStale(load) {
+		return
+	}
+
+	state := stateFor(host)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	cutoff := now.Add(-*backupLoadWindow)
+	kept := state.loadSamples[:0]
+	for _, s := range state.loadSamples {
+		if s.time.After(cutoff) {
+			kept = append(kept, s)
+		}
+	}
+	state.loadSamples = append(kept, loadSample{time: now, watts: load.InstantPower})
+}
+
+// averageLoad returns host's average home load over the readings in the
+// window, and false if there are none.
+func averageLoad(host string) (float64, bool) {
+	state := stateFor(host)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if len(state.loadSamples) == 0 {
+		return 0, false
+	}
+	var sum float64
+	for _, s := range state.loadSamples {
+		sum += s.watts
+	}
+	return sum / float64(len(state.loadSamples)), true
+}
+
+// backupHours is how long usable Wh lasts at load W. It is false when the
+// load is too small for the answer to mean anything.
+func backupHours(usable float64, load float64) (float64, bool) {
+	if load < 1 {
+		return 0, false
+	}
+	return math.Max(0, usable) / load, true
+}
+
+// populateBackupEstimate exports how long the batteries could carry the home
+// through an outage. The usable energy is what is left above the backup
+// reserve from /api/operation, which costs one extra request. If the
+// reserve can't be read, the estimate is left out rather than failing the
+// collector.
+func populateBackupEstimate(ctx context.Context, host string, status *SystemStatus, reg *prometheus.Registry) error {
+	load, ok := averageLoad(host)
+	if !ok {
+		return nil
+	}
+	if !nominalEnergyKnown(ctx, host, status, "backup estimate") {
+		return nil
+	}
+
+	operation, err := queryOperation(ctx, host)
+	if err != nil {
+		slog.DebugContext(ctx, "Reading backup reserve failed, skipping backup estimate", "target", host, "error", err)
+		return nil
+	}
+	usable := status.NominalEnergyRemaining - status.NominalFullPackEnergy*operation.BackupReservePercent/100
+
+	loadGauge, err := backupLoadMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	loadGauge.Set(load)
+
+	hours, ok := backupHours(usable, load)
+	if !ok {
+		return nil
+	}
+	estimate, err := estimatedBackupHoursMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	estimate.Set(hours)
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	batteryTransitions         = flag.Bool("metrics.battery-transitions", false, "Count switches between battery charging and discharging. Relies on per-target state; use background scraping for accurate counts.")
+	batteryTransitionsDeadband = flag.Float64("metrics.battery-transitions-deadband-watts", 100, "Battery power within this many watts of zero is treated as idle and never counts as a transition.")
+)
+
+var batteryTransitionsMetric = defineMetric(metricDef{
+	Name:      "battery_transitions_total",
+	Type:      "counter",
+	Help:      "Number of times the battery switched between charging and discharging, as seen by the exporter",
+	Collector: "meters",
+	Requires:  "-metrics.battery-transitions",
+})
+
+// batteryDirection is 1 when discharging, -1 when charging and 0 when the
+// power is inside the deadband.
+func batteryDirection(power float64) int {
+	switch {
+	case power > *batteryTransitionsDeadband:
+		return 1
+	case power < -*batteryTransitionsDeadband:
+		return -1
+	default:
+		return 0
+	}
+}
+
+// populateBatteryTransitions counts changes in the battery's direction.
+// Idle samples are skipped rather than treated as a direction of their own,
+// so charge, idle, discharge counts once and charge, idle, charge not at all.
+func populateBatteryTransitions(host string, battery Record, reg *prometheus.Registry) error {
+	transitions, err := batteryTransitionsMetric.counter(reg)
+	if err != nil {
+		return err
+	}
+
+	state := stateFor(host)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if dir := batteryDirection(battery.InstantPower); dir != 0 {
+		if state.batteryDirection != 0 && dir != state.batteryDirection {
+			state.batteryTransitions++
+		}
+		state.batteryDirection = dir
+	}
+
+	transitions.Add(state.batteryTransitions)
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	capabilities       = flag.Bool("capabilities", false, "Instead of serving metrics, query every known endpoint of -target once, print which ones work, and exit.")
+	capabilitiesTarget = flag.String("target", "", "Gateway to check with -capabilities.")
+)
+
+// reportCapabilities writes a human-readable report of what target supports
+// to w, trying every collector whether or not it is enabled. It returns false
+// if the gateway could not be reached at all.
+func reportCapabilities(w io.Writer, target string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	fmt.Fprintf(w, "Gateway: %s\n", target)
+
+	status, err := queryGatewayStatus(ctx, target)
+	if err != nil {
+		switch errorReason(err) {
+		case "connection", "timeout":
+			fmt.Fprintf(w, "Unreachable: %s\n", err)
+			return false
+		}
+		fmt.Fprintf(w, "Firmware: unknown (%s)\n", err)
+	} else {
+		fmt.Fprintf(w, "Firmware: %s\n", status.Version)
+		fmt.Fprintf(w, "Device:   %s %s\n", status.DeviceType, status.DIN)
+	}
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLLECTOR\tENABLED\tRESULT\tDETAIL")
+	for _, c := range collectors {
+		reg := prometheus.NewRegistry()
+		result, detail := "ok", ""
+		if err := c.collect(ctx, target, reg); err != nil {
+			result, detail = errorReason(err), err.Error()
+		} else if families, err := reg.Gather(); err != nil {
+			result, detail = "other", err.Error()
+		} else {
+			count := 0
+			for _, mf := range families {
+				count += len(mf.GetMetric())
+			}
+			detail = fmt.Sprintf("%d metrics", count)
+		}
+		fmt.Fprintf(tw, "%s\t%t\t%s\t%s\n", c.name, *c.enabled, result, detail)
+	}
+	tw.Flush()
+
+	return true
+}
+
+// runCapabilities prints the -capabilities report and exits.
+func runCapabilities() {
+	if *capabilitiesTarget == "" {
+		fatal("-capabilities requires -target")
+	}
+	if !reportCapabilities(os.Stdout, normalizeTarget(*capabilitiesTarget)) {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var capabilitiesRecheckInterval = flag.Duration("capabilities.recheck-interval", 0, "Detect each gateway's firmware and which enabled collectors it supports on first contact, skip unsupported collectors without querying them, and detect again this often. 0 queries every enabled collector on every scrape.")
+
+// capabilitiesRedetectFailures is how many scrapes of a target must fail in
+// a row before its capabilities are detected again early. A run of failures
+// after a firmware update is usually an endpoint that has gone away.
+const capabilitiesRedetectFailures = 3
+
+var capabilitiesInfoMetric = defineMetric(metricDef{
+	Name:     "capabilities_info",
+	Type:     "gauge",
+	Help:     "Firmware detected on the gateway and the enabled collectors it supports, always 1",
+	Labels:   []string{"firmware", "collectors"},
+	Requires: "-capabilities.recheck-interval",
+})
+
+// capabilitySnapshot is what was detected about a target: its firmware and
+// the collectors it refused or doesn't serve. A snapshot is filled in by a
+// single scrape and never changed once stored, so it can be read without
+// holding the target's lock.
+type capabilitySnapshot struct {
+	firmware string
+	time     time.Time
+
+	// detecting is set while the snapshot is being filled in by the scrape
+	// that created it.
+	detecting bool
+
+	// failures is the target's run of failed scrapes when detection
+	// started, so a run that was already long doesn't trigger detection
+	// again on every scrape.
+	failures int
+
+	// unsupported holds the error each unsupported collector failed with.
+	unsupported map[string]error
+}
+
+// capabilitiesFor returns the capability snapshot to use for a scrape of
+// target, or nil if -capabilities.recheck-interval is off. If the snapshot
+// is missing, older than the interval, or the target has kept failing since
+// it was taken, a new one is started and left for the scrape to fill in.
+// detect is false for probes running only some collectors, which would
+// leave the others undetected.
+func capabilitiesFor(ctx context.Context, target string, detect bool) *capabilitySnapshot {
+	if *capabilitiesRecheckInterval <= 0 {
+		return nil
+	}
+
+	state := stateFor(target)
+	state.mu.Lock()
+	snap := state.capabilities
+	failures := state.consecutiveFailures
+	state.mu.Unlock()
+
+	if !detect {
+		return snap
+	}
+	reason := ""
+	switch {
+	case snap == nil:
+		reason = "first contact"
+	case time.Since(snap.time) >= *capabilitiesRecheckInterval:
+		reason = "recheck"
+	case failures-snap.failures >= capabilitiesRedetectFailures:
+		reason = "repeated failures"
+	default:
+		return snap
+	}
+
+	firmware := "unknown"
+	if status, err := queryGatewayStatus(ctx, target); err != nil {
+		slog.DebugContext(ctx, "Querying firmware version failed", "target", target, "error", err)
+	} else if status.Version != "" {
+		firmware = status.Version
+	}
+	slog.InfoContext(ctx, "Detecting gateway capabilities", "target", target, "reason", reason, "firmware", firmware)
+
+	return &capabilitySnapshot{
+		firmware:    firmware,
+		time:        time.Now(),
+		detecting:   true,
+		failures:    failures,
+		unsupported: map[string]error{},
+	}
+}
+
+// skip returns the error c failed with when it was found unsupported, or
+// nil if it should be run. A nil snapshot runs everything.
+func (s *capabilitySnapshot) skip(c *collector) error {
+	if s == nil || s.detecting {
+		return nil
+	}
+	return s.unsupported[c.name]
+}
+
+// observe records that c failed with err while the snapshot is being
+// detected, and reports whether the failure means c is unsupported rather
+// than that the scrape failed.
+func (s *capabilitySnapshot) observe(c *collector, err error) bool {
+	if s == nil || !s.detecting || !isUnsupported(err) {
+		return false
+	}
+	s.unsupported[c.name] = err
+	return true
+}
+
+// store finishes detection and keeps the snapshot for target's later
+// scrapes. It is only called once the detecting scrape succeeded, so a
+// scrape cut short by a timeout doesn't leave collectors it never reached
+// looking supported.
+func (s *capabilitySnapshot) store(ctx context.Context, target string) {
+	if s == nil || !s.detecting {
+		return
+	}
+	s.detecting = false
+
+	state := stateFor(target)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.capabilities = s
+
+	var unsupported []string
+	for name := range s.unsupported {
+		unsupported = append(unsupported, name)
+	}
+	sort.Strings(unsupported)
+	slog.InfoContext(ctx, "Detected gateway capabilities", "target", target, "firmware", s.firmware, "unsupported", unsupported)
+}
+
+// populate adds tesla_powerwall_capabilities_info for the collectors in
+// enabled to reg.
+func (s *capabilitySnapshot) populate(enabled []*collector, reg *prometheus.Registry) error {
+	if s == nil {
+		return nil
+	}
+
+	var supported []string
+	for _, c := range enabled {
+		if _, ok := s.unsupported[c.name]; !ok {
+			supported = append(supported, c.name)
+		}
+	}
+	sort.Strings(supported)
+
+	info, err := capabilitiesInfoMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	info.WithLabelValues(s.firmware, strings.Join(supported, ",")).Set(1)
+	return nil
+}
+
+// isUnsupported reports whether err means the gateway refuses or doesn't
+// serve a collector's endpoint, rather than that it failed to answer.
+func isUnsupported(err error) bool {
+	var apiErr *APIError
+	var statusErr *HTTPStatusError
+
+	switch {
+	case errorReason(err) == "auth":
+		return true
+	case errors.As(err, &statusErr):
+		return statusErr.Code == http.StatusNotFound
+	case errors.As(err, &apiErr):
+		return apiErr.Code == http.StatusNotFound
+	default:
+		return false
+	}
+}
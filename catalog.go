@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricDef describes a metric the exporter can emit. Every metric is
+// created from one of these, which makes the set of definitions a complete
+// catalog of what the exporter can produce.
+type metricDef struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Unit   string   `json:"unit,omitempty"`
+	Help   string   `json:"help"`
+	Labels []string `json:"labels,omitempty"`
+
+	// Path is the endpoint the metric is exposed on: /probe for gateway
+	// metrics, /metrics for the exporter's own.
+	Path string `json:"path"`
+	// Collector is the -collect.* group that produces the metric, if any.
+	Collector string `json:"collector,omitempty"`
+	// Requires names the flag that must be set for the metric to appear,
+	// beyond its collector being enabled.
+	Requires string `json:"requires,omitempty"`
+	// Legacy is the name the metric had before it was renamed. It is still
+	// emitted under that name when -metrics.compat is set.
+	Legacy string `json:"legacy_name,omitempty"`
+
+	// base is Name without Prefix, for -metric.name-template.
+	base string
+}
+
+var catalog []*metricDef
+
+var metricsCompat = flag.Bool("metrics.compat", false, "Also emit renamed metrics under their legacy names, to give dashboards time to migrate. Deprecated names are removed two minor releases after the rename.")
+
+// defineMetric adds d to the catalog, expanding its name with Prefix.
+func defineMetric(d metricDef) *metricDef {
+	d.base = d.Name
+	d.Name = fmt.Sprintf("%s_%s", Prefix, d.Name)
+	if d.Legacy != "" {
+		d.Legacy = fmt.Sprintf("%s_%s", Prefix, d.Legacy)
+	}
+	if d.Path == "" {
+		d.Path = "/probe"
+	}
+	catalog = append(catalog, &d)
+	return &d
+}
+
+// gauge registers a plain gauge for d on reg.
+func (d *metricDef) gauge(reg *prometheus.Registry) (prometheus.Gauge, error) {
+	g := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: d.Name,
+			Help: d.Help,
+		},
+	)
+	if err := reg.Register(g); err != nil {
+		return nil, errors.Wrapf(err, "registering %s metric", d.Name)
+	}
+	return g, nil
+}
+
+// counter registers a plain counter for d on reg. Counters kept in
+// per-target state are copied into it with Add.
+func (d *metricDef) counter(reg *prometheus.Registry) (prometheus.Counter, error) {
+	c := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: d.Name,
+			Help: d.Help,
+		},
+	)
+	if err := reg.Register(c); err != nil {
+		return nil, errors.Wrapf(err, "registering %s metric", d.Name)
+	}
+	return c, nil
+}
+
+// gaugeVec registers a labelled gauge for d on reg, or returns the one
+// already registered so it can be filled in one label set at a time.
+func (d *metricDef) gaugeVec(reg *prometheus.Registry) (*prometheus.GaugeVec, error) {
+	g := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: d.Name,
+			Help: d.Help,
+		},
+		d.Labels,
+	)
+	if err := reg.Register(g); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(*prometheus.GaugeVec), nil
+		}
+		return nil, errors.Wrapf(err, "registering %s metric", d.Name)
+	}
+	return g, nil
+}
+
+// counterVec registers a labelled counter for d on reg, or returns the one
+// already registered. Counters reported by the gateway are copied into it
+// with Add.
+func (d *metricDef) counterVec(reg *prometheus.Registry) (*prometheus.CounterVec, error) {
+	c := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: d.Name,
+			Help: d.Help,
+		},
+		d.Labels,
+	)
+	if err := reg.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(*prometheus.CounterVec), nil
+		}
+		return nil, errors.Wrapf(err, "registering %s metric", d.Name)
+	}
+	return c, nil
+}
+
+// desc returns a descriptor for d, for collectors that compute their
+// values at scrape time.
+func (d *metricDef) desc() *prometheus.Desc {
+	return prometheus.NewDesc(d.Name, d.Help, d.Labels, nil)
+}
+
+// newGauge creates an unregistered gauge for d, for the exporter's own
+// long-lived metrics.
+func (d *metricDef) newGauge() prometheus.Gauge {
+	return prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: d.Name,
+			Help: d.Help,
+		},
+	)
+}
+
+// newGaugeVec creates an unregistered labelled gauge for d, for the
+// exporter's own long-lived metrics.
+func (d *metricDef) newGaugeVec() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: d.Name,
+			Help: d.Help,
+		},
+		d.Labels,
+	)
+}
+
+// newCounter creates an unregistered counter for d, for the exporter's own
+// long-lived metrics.
+func (d *metricDef) newCounter() prometheus.Counter {
+	return prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: d.Name,
+			Help: d.Help,
+		},
+	)
+}
+
+// newCounterVec creates an unregistered labelled counter for d, for the
+// exporter's own long-lived metrics.
+func (d *metricDef) newCounterVec() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: d.Name,
+			Help: d.Help,
+		},
+		d.Labels,
+	)
+}
+
+// metricListHandler serves the catalog as JSON, sorted by metric name.
+func metricListHandler(w http.ResponseWriter, r *http.Request) {
+	// Report the paths metrics are actually served on, which may have been
+	// moved with -web.telemetry-path and -web.probe-path.
+	list := make([]*metricDef, 0, len(catalog))
+	for _, d := range catalog {
+		d := *d
+		switch d.Path {
+		case "/metrics":
+			d.Path = *telemetryPath
+		case "/probe":
+			d.Path = *probePath
+		}
+		list = append(list, &d)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		slog.Error("Writing metric list failed", "error", err)
+	}
+}
+
+// compatGatherer wraps a gatherer and duplicates every renamed metric under
+// its legacy name, so old and new names can be scraped side by side.
+type compatGatherer struct {
+	prometheus.Gatherer
+}
+
+func (g compatGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+
+	legacy := map[string]string{}
+	for _, d := range catalog {
+		if d.Legacy != "" {
+			legacy[d.Name] = d.Legacy
+		}
+	}
+
+	for _, mf := range families {
+		old, ok := legacy[mf.GetName()]
+		if !ok {
+			continue
+		}
+		// Each copy gets its own metrics, since wrapping gatherers such as
+		// labelGatherer modify them in place and would otherwise label the
+		// same metric twice.
+		metrics := make([]*dto.Metric, len(mf.Metric))
+		for i, m := range mf.Metric {
+			metrics[i] = proto.Clone(m).(*dto.Metric)
+		}
+		families = append(families, &dto.MetricFamily{
+			Name:   proto.String(old),
+			Help:   proto.String(fmt.Sprintf("Deprecated, use %s instead. %s", mf.GetName(), mf.GetHelp())),
+			Type:   mf.Type,
+			Metric: metrics,
+		})
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].GetName() < families[j].GetName()
+	})
+
+	return families, err
+}
+
+// requirementMet reports whether the flag named by a metricDef's Requires
+// is set to something other than its zero value.
+func requirementMet(requires string) bool {
+	if requires == "" {
+		return true
+	}
+	f := flag.Lookup(strings.TrimPrefix(requires, "-"))
+	if f == nil {
+		return true
+	}
+	switch f.Value.String() {
+	case "", "0", "false", "0s":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestCompatGathererCopiesValues(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	current, err := instantTotalCurrentMetric.gaugeVec(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current.WithLabelValues("site").Set(-5)
+
+	families, err := compatGatherer{reg}.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]float64{}
+	metrics := map[string]*dto.Metric{}
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			values[mf.GetName()] = m.GetGauge().GetValue()
+			metrics[mf.GetName()] = m
+		}
+	}
+	if got := values[instantTotalCurrentMetric.Legacy]; got != -5 {
+		t.Errorf("legacy value = %v, want -5", got)
+	}
+	if got := values[instantTotalCurrentMetric.Name]; got != -5 {
+		t.Errorf("new value = %v, want -5", got)
+	}
+	if metrics[instantTotalCurrentMetric.Legacy] == metrics[instantTotalCurrentMetric.Name] {
+		t.Error("legacy and new families share a metric")
+	}
+}
+
+func TestCompatGathererUnderLabelGatherer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	current, err := instantTotalCurrentMetric.gaugeVec(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current.WithLabelValues("site").Set(-5)
+	current.WithLabelValues("load").Set(3.3)
+
+	g := labelGatherer{
+		labels: map[string]string{targetLabel: "192.168.1.50"},
+		g:      compatGatherer{reg},
+	}
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatalf("Gather() failed: %v", err)
+	}
+
+	names := map[string]bool{}
+	for _, mf := range families {
+		names[mf.GetName()] = true
+		for _, m := range mf.GetMetric() {
+			count := 0
+			for _, pair := range m.GetLabel() {
+				if pair.GetName() == targetLabel {
+					count++
+				}
+			}
+			if count != 1 {
+				t.Errorf("%s has %d target labels, want 1", mf.GetName(), count)
+			}
+		}
+	}
+	for _, name := range []string{instantTotalCurrentMetric.Name, instantTotalCurrentMetric.Legacy} {
+		if !names[name] {
+			t.Errorf("%s missing from gathered families", name)
+		}
+	}
+}
+
+func TestCatalogHelpUnique(t *testing.T) {
+	seen := map[string]string{}
+	for _, d := range catalog {
+		if d.Help == "" {
+			t.Errorf("%s has no help text", d.Name)
+			continue
+		}
+		if other, ok := seen[d.Help]; ok {
+			t.Errorf("%s and %s share the help text %q", other, d.Name, d.Help)
+		}
+		seen[d.Help] = d.Name
+	}
+}
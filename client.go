@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The gateway API never redirects, so a redirect almost always means a
+// reverse proxy is bouncing us to a login or error page. Following it turns
+// that into a confusing JSON parse failure on some HTML, so by default we
+// refuse and report where we were being sent instead.
+var followRedirects = flag.Bool("http.follow-redirects", false, "Follow HTTP redirects returned by the gateway. Disabled by default so proxy misconfiguration is reported rather than hidden.")
+
+var dnsResolver = flag.String("dns.resolver", "", "DNS server (host or host:port) used to resolve gateway hostnames instead of the system resolver.")
+
+// The gateway serves a self-signed certificate, so verification is off by
+// default. Users who want it can pin that certificate with -tls.ca-file.
+var (
+	tlsInsecureSkipVerify = flag.Bool("tls.insecure-skip-verify", true, "Skip verification of the gateway's TLS certificate. Set to false to verify against -tls.ca-file, or the system roots if that is unset.")
+	tlsCAFile             = flag.String("tls.ca-file", "", "PEM file of CA or self-signed certificates to verify the gateway against. Requires -tls.insecure-skip-verify=false.")
+	tlsServerName         = flag.String("tls.server-name", "", "Name to send as SNI and verify the gateway's certificate against, instead of the target address. Lets a pinned certificate be verified when gateways are reached by IP.")
+)
+
+// Connection limits keep one busy gateway from hogging connections and
+// idle connections to many gateways from exhausting file descriptors.
+var (
+	maxConnsPerHost     = flag.Int("http.max-conns-per-host", 4, "Maximum connections, active and idle, to a single gateway. 0 means unlimited.")
+	maxIdleConnsPerHost = flag.Int("http.max-idle-conns-per-host", 2, "Maximum idle connections kept open to a single gateway.")
+	maxIdleConns        = flag.Int("http.max-idle-conns", 100, "Maximum idle connections kept open across all gateways. 0 means unlimited.")
+	idleConnTimeout     = flag.Duration("http.idle-conn-timeout", 90*time.Second, "How long an idle connection to a gateway is kept open.")
+)
+
+// Some gateway and proxy HTTP/2 stacks stall requests or tear connections
+// down with bursts of GOAWAY frames. HTTP/1.1 sidesteps them.
+var disableHTTP2 = flag.Bool("http.disable-http2", false, "Never negotiate HTTP/2 with gateways or proxies in front of them, only HTTP/1.1. Use it if requests stall or connections are reset with GOAWAY frames.")
+
+var openConnections = defineMetric(metricDef{
+	Name: "http_open_connections",
+	Type: "gauge",
+	Help: "Number of connections to gateways currently open, active or idle",
+	Path: "/metrics",
+}).newGauge()
+
+func init() {
+	prometheus.MustRegister(openConnections)
+}
+
+// countedConn keeps http_open_connections up to date as connections close.
+type countedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(openConnections.Dec)
+	return c.Conn.Close()
+}
+
+// httpClient is shared by every request to a gateway so that connections
+// are reused between scrapes.
+var httpClient *http.Client
+
+func newHTTPClient() (*http.Client, error) {
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Resolver:  newResolver(*dnsResolver),
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			openConnections.Inc()
+			return &countedConn{Conn: conn}, nil
+		},
+		TLSClientConfig: tlsConfig,
+		// Like http.DefaultTransport, offer HTTP/2 and use it if the
+		// gateway or a proxy in front of it accepts.
+		ForceAttemptHTTP2:   true,
+		MaxConnsPerHost:     *maxConnsPerHost,
+		MaxIdleConnsPerHost: *maxIdleConnsPerHost,
+		MaxIdleConns:        *maxIdleConns,
+		IdleConnTimeout:     *idleConnTimeout,
+	}
+	if *disableHTTP2 {
+		// A non-nil, empty TLSNextProto is how net/http is told not to
+		// offer h2 during the TLS handshake.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Jar:       newTargetJar(),
+	}
+
+	if !*followRedirects {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return errors.Errorf("gateway redirected to %s, not following (see -http.follow-redirects)", req.URL)
+		}
+	}
+
+	return client, nil
+}
+
+// newTLSConfig builds the TLS settings for talking to gateways from the
+// -tls.* flags.
+func newTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: *tlsInsecureSkipVerify,
+		ServerName:         *tlsServerName,
+	}
+
+	if *tlsCAFile != "" {
+		if *tlsInsecureSkipVerify {
+			return nil, errors.New("-tls.ca-file has no effect unless -tls.insecure-skip-verify=false")
+		}
+		pem, err := ioutil.ReadFile(*tlsCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading -tls.ca-file")
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %s", *tlsCAFile)
+		}
+	}
+
+	if *tlsServerName != "" && *tlsInsecureSkipVerify {
+		slog.Warn("-tls.server-name is only sent as SNI while -tls.insecure-skip-verify is on; the certificate is not checked against it")
+	}
+
+	return config, nil
+}
+
+// targetJar is a cookie jar that keeps each target's cookies apart. A
+// single cookiejar.Jar ignores ports, so two gateways published on
+// different ports of the same host would otherwise overwrite each other's
+// session cookies.
+type targetJar struct {
+	mu   sync.Mutex
+	jars map[string]*cookiejar.Jar
+}
+
+func newTargetJar() *targetJar {
+	return &targetJar{jars: map[string]*cookiejar.Jar{}}
+}
+
+// jar returns the jar for the target u is addressed to, creating it on
+// first use. The jars themselves are safe for concurrent use, so concurrent
+// probes of one target share cookies set by whichever request saw them last.
+func (j *targetJar) jar(u *url.URL) *cookiejar.Jar {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	jar, ok := j.jars[u.Host]
+	if !ok {
+		// cookiejar.New only fails for invalid options, and we pass none.
+		jar, _ = cookiejar.New(nil)
+		j.jars[u.Host] = jar
+	}
+	return jar
+}
+
+// reset forgets every target's cookies, so each gateway is logged in to
+// again on its next request. It returns how many targets had a jar.
+func (j *targetJar) reset() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	n := len(j.jars)
+	j.jars = map[string]*cookiejar.Jar{}
+	return n
+}
+
+func (j *targetJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar(u).SetCookies(u, cookies)
+}
+
+func (j *targetJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar(u).Cookies(u)
+}
+
+// newResolver returns a resolver that sends every query to server, or nil
+// (the system resolver) if server is empty. This lets gateways be found via
+// a split-horizon DNS server without touching the host's resolv.conf.
+func newResolver(server string) *net.Resolver {
+	if server == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
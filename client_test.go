@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestTargetJarKeepsTargetsApart(t *testing.T) {
+	j := newTargetJar()
+	a := &url.URL{Scheme: "https", Host: "192.168.1.50:443", Path: "/"}
+	b := &url.URL{Scheme: "https", Host: "192.168.1.50:8443", Path: "/"}
+
+	j.SetCookies(a, []*http.Cookie{{Name: "AuthCookie", Value: "a"}})
+	j.SetCookies(b, []*http.Cookie{{Name: "AuthCookie", Value: "b"}})
+
+	for u, want := range map[*url.URL]string{a: "a", b: "b"} {
+		cookies := j.Cookies(u)
+		if len(cookies) != 1 || cookies[0].Value != want {
+			t.Errorf("cookies for %s = %v, want AuthCookie=%s", u.Host, cookies, want)
+		}
+	}
+
+	if n := j.reset(); n != 2 {
+		t.Errorf("reset() = %d, want 2", n)
+	}
+	if cookies := j.Cookies(a); len(cookies) != 0 {
+		t.Errorf("cookies for %s after reset = %v, want none", a.Host, cookies)
+	}
+}
+
+// TestTargetJarConcurrent sets, reads and resets cookies for several
+// targets at once. Run it with -race.
+func TestTargetJarConcurrent(t *testing.T) {
+	j := newTargetJar()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		u := &url.URL{Scheme: "https", Host: fmt.Sprintf("192.168.1.50:%d", 8440+i), Path: "/"}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				j.SetCookies(u, []*http.Cookie{{Name: "AuthCookie", Value: fmt.Sprint(i)}})
+				for _, c := range j.Cookies(u) {
+					if c.Value != fmt.Sprint(i) {
+						t.Errorf("%s got another target's cookie %s", u.Host, c)
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; n < 20; n++ {
+			j.reset()
+		}
+	}()
+	wg.Wait()
+}
+
+// TestSessionCookiesPerGateway queries two gateways on the same host at
+// once, each setting its own session cookie, and checks that neither is
+// sent the other's.
+func TestSessionCookiesPerGateway(t *testing.T) {
+	const path = "/api/meters/aggregates"
+
+	var gateways []*mockGateway
+	for i := 0; i < 2; i++ {
+		gw := newMockGateway(t, "")
+		session := fmt.Sprintf("session-%d", i)
+		gw.set(path, mockResponse{handler: func(w http.ResponseWriter, r *http.Request) {
+			if c, err := r.Cookie("AuthCookie"); err == nil && c.Value != session {
+				t.Errorf("gateway %s was sent cookie %s", session, c.Value)
+			}
+			http.SetCookie(w, &http.Cookie{Name: "AuthCookie", Value: session, Path: "/"})
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"site":{"instant_power":1520.25}}`))
+		}})
+		gateways = append(gateways, gw)
+	}
+
+	var wg sync.WaitGroup
+	for _, gw := range gateways {
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(target string) {
+				defer wg.Done()
+				for n := 0; n < 5; n++ {
+					if _, err := queryMeters(context.Background(), target); err != nil {
+						t.Errorf("query of %s failed: %v", target, err)
+					}
+				}
+			}(gw.target())
+		}
+	}
+	wg.Wait()
+
+	for _, gw := range gateways {
+		if n := gw.requested(path); n != 20 {
+			t.Errorf("%s was asked for %s %d times, want 20", gw.target(), path, n)
+		}
+	}
+}
+
+func TestDisableHTTP2(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	for disable, want := range map[bool]string{false: "HTTP/2.0", true: "HTTP/1.1"} {
+		setFlag(t, disableHTTP2, disable)
+		client, err := newHTTPClient()
+		if err != nil {
+			t.Fatalf("newHTTPClient failed: %v", err)
+		}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("-http.disable-http2=%v: request failed: %v", disable, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		client.CloseIdleConnections()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(body); got != want {
+			t.Errorf("-http.disable-http2=%v: gateway was spoken to over %s, want %s", disable, got, want)
+		}
+	}
+}
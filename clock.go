@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Source ages compare each meter's last_communication_time, which comes from
+// the gateway's clock, with "now". By default that is the exporter's clock,
+// which is precise but lets any skew between the two clocks into the age.
+// The gateway's own clock, read from the Date header of its responses,
+// cancels the skew out at the cost of one-second resolution.
+var stalenessClock = flag.String("staleness.clock", "exporter", "Clock that source ages are measured against for -freshness.max-age: exporter, or gateway to use the gateway's clock as given in the Date header of its responses. Use gateway if clock_skew_seconds shows the gateway's clock is off and it can't be kept in sync. data_age_seconds is always on the exporter's clock, since it measures from when the exporter collected the values, and clock_skew_seconds is the difference between the two clocks, so neither depends on this flag.")
+
+var clockSkewMetric = defineMetric(metricDef{
+	Name:      "clock_skew_seconds",
+	Type:      "gauge",
+	Unit:      "seconds",
+	Help:      "The gateway's clock, from the Date header of its responses, minus the exporter's, to within about a second; absent if the gateway sends no Date header",
+	Collector: "meters",
+})
+
+// recordGatewayClock remembers how far host's clock is from ours, from the
+// Date header of a response received at received. The header only has
+// whole seconds, so the midpoint of the second it names is used.
+func recordGatewayClock(host string, header string, received time.Time) {
+	if header == "" {
+		return
+	}
+	date, err := http.ParseTime(header)
+	if err != nil {
+		return
+	}
+
+	state := stateFor(host)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	state.clockOffset = date.Add(500 * time.Millisecond).Sub(received)
+	state.clockOffsetKnown = true
+}
+
+// gatewayClockOffset returns how far host's clock is ahead of ours, and
+// whether it is known.
+func gatewayClockOffset(host string) (time.Duration, bool) {
+	state := stateFor(host)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	return state.clockOffset, state.clockOffsetKnown
+}
+
+// referenceTime returns "now" for judging the age of host's data, on the
+// clock chosen by -staleness.clock. If the gateway's clock is chosen but
+// unknown, the exporter's is used.
+func referenceTime(host string) time.Time {
+	now := time.Now()
+	if *stalenessClock != "gateway" {
+		return now
+	}
+	if offset, ok := gatewayClockOffset(host); ok {
+		return now.Add(offset)
+	}
+	return now
+}
+
+// populateClockSkew exports how far host's clock is from ours.
+func populateClockSkew(host string, reg *prometheus.Registry) error {
+	offset, ok := gatewayClockOffset(host)
+	if !ok {
+		return nil
+	}
+
+	skew, err := clockSkewMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	skew.Set(offset.Seconds())
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The Tesla owner API serves a subset of the gateway's live data for sites
+// that can't be reached locally. It has its own auth and rate limits, so it
+// is kept apart from the gateway client: nothing here is used unless
+// -cloud.token-file is set and a probe asks for a cloud: target.
+var (
+	cloudTokenFile = flag.String("cloud.token-file", "", "File holding a Tesla account refresh token. Enables cloud:<energy site id> targets, queried through the Tesla owner API instead of a local gateway. The file is rewritten whenever Tesla rotates the token, so it must be writable.")
+	cloudAuthURL   = flag.String("cloud.auth-url", "https://auth.tesla.com/oauth2/v3/token", "Tesla OAuth token endpoint used to refresh the cloud access token.")
+	cloudAPIURL    = flag.String("cloud.api-url", "https://owner-api.teslamotors.com", "Base URL of the Tesla owner API.")
+)
+
+// cloudTargetPrefix marks probe targets that are energy site IDs in the
+// Tesla cloud rather than gateway addresses.
+const cloudTargetPrefix = "cloud:"
+
+// cloudRefreshMargin is how long before it expires an access token is
+// replaced.
+const cloudRefreshMargin = 5 * time.Minute
+
+// cloud is the owner API client, or nil when -cloud.token-file is unset.
+var cloud *cloudClient
+
+// cloudClient talks to the Tesla owner API, refreshing its access token
+// from the refresh token in tokenFile as needed.
+type cloudClient struct {
+	client    *http.Client
+	tokenFile string
+
+	mu           sync.Mutex
+	refreshToken string
+	accessToken  string
+	expiry       time.Time
+}
+
+// cloudToken is the response from the OAuth token endpoint.
+type cloudToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// cloudLiveStatus is the response from
+// /api/1/energy_sites/<id>/live_status.
+type cloudLiveStatus struct {
+	Response struct {
+		SolarPower        float64 `json:"solar_power"`
+		BatteryPower      float64 `json:"battery_power"`
+		LoadPower         float64 `json:"load_power"`
+		GridPower         float64 `json:"grid_power"`
+		PercentageCharged float64 `json:"percentage_charged"`
+	} `json:"response"`
+}
+
+func newCloudClient(tokenFile string) (*cloudClient, error) {
+	info, err := os.Stat(tokenFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading -cloud.token-file")
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		slog.Warn("Cloud token file is accessible by other users; it grants access to your Tesla account", "file", tokenFile, "mode", info.Mode().Perm())
+	}
+
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading -cloud.token-file")
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return nil, errors.Errorf("%s holds no refresh token", tokenFile)
+	}
+
+	return &cloudClient{
+		// Deliberately not httpClient: that one trusts the gateway's
+		// self-signed certificate, which must never apply to Tesla's servers.
+		client:       &http.Client{Timeout: 30 * time.Second},
+		tokenFile:    tokenFile,
+		refreshToken: token,
+	}, nil
+}
+
+// cloudSite returns the energy site ID of a cloud target.
+func cloudSite(target string) (string, bool) {
+	if !strings.HasPrefix(target, cloudTargetPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(target, cloudTargetPrefix), true
+}
+
+// token returns a valid access token, refreshing it if it's close to
+// expiry.
+func (c *cloudClient) token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.accessToken != "" && time.Now().Add(cloudRefreshMargin).Before(c.expiry) {
+		return c.accessToken, nil
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"grant_type":    "refresh_token",
+		"client_id":     "ownerapi",
+		"refresh_token": c.refreshToken,
+		"scope":         "openid email offline_access",
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, *cloudAuthURL, bytes.NewReader(body))
+	if err != nil {
+		return "", errors.Wrap(err, "creating token refresh request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var token cloudToken
+	if err := c.do(req, &token); err != nil {
+		return "", errors.Wrap(err, "refreshing cloud access token")
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("token endpoint returned no access token")
+	}
+
+	c.accessToken = token.AccessToken
+	c.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+
+	// Refresh tokens are single use, so a rotated one has to be saved or
+	// the next restart can't log in.
+	if token.RefreshToken != "" && token.RefreshToken != c.refreshToken {
+		c.refreshToken = token.RefreshToken
+		if err := writeTokenFile(c.tokenFile, token.RefreshToken); err != nil {
+			slog.Error("Saving rotated cloud refresh token failed; the exporter will need a new token after restarting", "file", c.tokenFile, "error", err)
+		}
+	}
+
+	return c.accessToken, nil
+}
+
+// writeTokenFile replaces path with token, readable only by the owner. The
+// token is written to a temporary file and renamed into place so a crash
+// can't leave the file empty.
+func writeTokenFile(path string, token string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".cloud-token-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// TempFile already creates the file 0600; this is belt and braces.
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.WriteString(token + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// do sends req and decodes its JSON response into v.
+func (c *cloudClient) do(req *http.Request, v interface{}) error {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return classify(errTransport, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return errors.Wrapf(errRateLimited, "retry after %s", retryAfter(resp.Header.Get("Retry-After"), time.Now()))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &HTTPStatusError{Code: resp.StatusCode, Path: req.URL.Path}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.Wrap(classify(errParse, err), "parsing cloud API response")
+	}
+	return nil
+}
+
+// liveStatus fetches the live power flows of an energy site.
+func (c *cloudClient) liveStatus(ctx context.Context, site string) (*cloudLiveStatus, error) {
+	token, err := c.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	u := strings.TrimSuffix(*cloudAPIURL, "/") + "/api/1/energy_sites/" + url.PathEscape(site) + "/live_status"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating cloud API request")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	status := &cloudLiveStatus{}
+	if err := c.do(req, status); err != nil {
+		var statusErr *HTTPStatusError
+		if errors.As(err, &statusErr) && statusErr.Code == http.StatusUnauthorized {
+			// The access token was revoked early; get a new one next time.
+			c.mu.Lock()
+			c.accessToken = ""
+			c.mu.Unlock()
+		}
+		return nil, err
+	}
+	return status, nil
+}
+
+// collectCloudTarget exports what the owner API knows about an energy site
+// under the same names the local collectors use: instant power per source
+// and the battery percentage.
+func collectCloudTarget(ctx context.Context, site string) (prometheus.Gatherer, error) {
+	if cloud == nil {
+		return nil, errors.New("cloud targets require -cloud.token-file")
+	}
+
+	status, err := cloud.liveStatus(ctx, site)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying cloud live status")
+	}
+
+	reg := prometheus.NewRegistry()
+
+	instantPower, err := instantPowerMetric.gaugeVec(reg)
+	if err != nil {
+		return nil, err
+	}
+	instantPower.WithLabelValues("site").Set(status.Response.GridPower)
+	instantPower.WithLabelValues("battery").Set(status.Response.BatteryPower)
+	instantPower.WithLabelValues("load").Set(status.Response.LoadPower)
+	instantPower.WithLabelValues("solar").Set(status.Response.SolarPower)
+
+	percentage := clampSOE(ctx, cloudTargetPrefix+site, status.Response.PercentageCharged)
+	if *soeRound >= 0 {
+		percentage = roundTo(percentage, *soeRound)
+	}
+	battery, err := batteryPercentageMetric.gauge(reg)
+	if err != nil {
+		return nil, err
+	}
+	battery.Set(percentage)
+
+	return reg, nil
+}
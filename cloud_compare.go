@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The Tesla app and the local API often disagree. With -collect.cloud_compare,
+// targets that name their energy site in -config.file are sampled through
+// both and the difference is exported. The cloud API is tightly rate
+// limited, so both sides are sampled together only every
+// -cloud.compare-interval and the result is reused in between.
+var cloudCompareInterval = flag.Duration("cloud.compare-interval", 10*time.Minute, "How often -collect.cloud_compare samples the cloud and local values it compares. Scrapes in between export the last comparison.")
+
+var (
+	cloudLocalDeltaPercentageMetric = defineMetric(metricDef{
+		Name:      "cloud_local_delta_battery_percentage",
+		Type:      "gauge",
+		Unit:      "percent",
+		Help:      "Battery percentage reported by the Tesla cloud minus the percentage reported by the gateway, sampled together",
+		Collector: "cloud_compare",
+	})
+	cloudLocalDeltaPowerMetric = defineMetric(metricDef{
+		Name:      "cloud_local_delta_instant_power",
+		Type:      "gauge",
+		Unit:      "watts",
+		Help:      "Instant power reported by the Tesla cloud minus the power reported by the gateway, by source, sampled together",
+		Labels:    []string{"source"},
+		Collector: "cloud_compare",
+	})
+	cloudLocalComparisonTimeMetric = defineMetric(metricDef{
+		Name:      "cloud_local_comparison_timestamp_seconds",
+		Type:      "gauge",
+		Unit:      "seconds",
+		Help:      "When the values behind cloud_local_delta_* were sampled",
+		Collector: "cloud_compare",
+	})
+)
+
+// cloudComparison is the difference between the cloud's and the gateway's
+// view of a site at one moment.
+type cloudComparison struct {
+	time       time.Time
+	percentage float64
+	power      map[string]float64
+}
+
+// cloudSiteFor returns the energy site configured for host in -config.file,
+// or "" if it has none.
+func cloudSiteFor(host string) string {
+	if t := targetConfig(host); t != nil {
+		return t.CloudSite
+	}
+	return ""
+}
+
+// collectCloudCompare exports how far the cloud's battery percentage and
+// instant power are from the gateway's. Targets without a cloud_site are
+// skipped. A failed cloud request is logged rather than failing the scrape,
+// and the previous comparison is exported until a new one succeeds.
+func collectCloudCompare(ctx context.Context, host string, reg *prometheus.Registry) error {
+	site := cloudSiteFor(host)
+	if site == "" || cloud == nil {
+		return nil
+	}
+
+	state := stateFor(host)
+	state.mu.Lock()
+	comparison := state.cloudComparison
+	state.mu.Unlock()
+
+	if comparison == nil || time.Since(comparison.time) >= *cloudCompareInterval {
+		sampled, err := sampleCloudComparison(ctx, host, site)
+		if err != nil {
+			return err
+		}
+		if sampled != nil {
+			comparison = sampled
+			state.mu.Lock()
+			state.cloudComparison = comparison
+			state.mu.Unlock()
+		}
+	}
+	if comparison == nil {
+		return nil
+	}
+
+	percentage, err := cloudLocalDeltaPercentageMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	percentage.Set(comparison.percentage)
+
+	power, err := cloudLocalDeltaPowerMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	for source, delta := range comparison.power {
+		power.WithLabelValues(source).Set(delta)
+	}
+
+	sampledAt, err := cloudLocalComparisonTimeMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	sampledAt.Set(float64(comparison.time.UnixNano()) / 1e9)
+
+	return nil
+}
+
+// sampleCloudComparison queries the cloud and then the gateway, as close
+// together as possible, and returns the difference. It returns an error
+// only if the gateway fails, and nil without an error if the cloud does.
+func sampleCloudComparison(ctx context.Context, host string, site string) (*cloudComparison, error) {
+	remote, err := cloud.liveStatus(ctx, site)
+	if err != nil {
+		slog.WarnContext(ctx, "Sampling cloud values for comparison failed", "target", host, "site", site, "error", err)
+		return nil, nil
+	}
+	now := time.Now()
+
+	meters, err := queryMeters(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	soe, err := queryStateOfEnergy(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cloudComparison{
+		time:       now,
+		percentage: remote.Response.PercentageCharged - soe.Percentage,
+		power: map[string]float64{
+			"site":    remote.Response.GridPower - meters.Site.InstantPower,
+			"battery": remote.Response.BatteryPower - meters.Battery.InstantPower,
+			"load":    remote.Response.LoadPower - meters.Load.InstantPower,
+			"solar":   remote.Response.SolarPower - meters.Solar.InstantPower,
+		},
+	}, nil
+}
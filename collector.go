@@ -0,0 +1,938 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collector is a group of metrics backed by a single Powerwall API endpoint.
+// Every collector gets a -collect.<name> flag so users can trade detail
+// against load on the gateway.
+type collector struct {
+	name      string
+	help      string
+	isDefault bool
+	collect   func(ctx context.Context, host string, reg *prometheus.Registry) error
+	// slow marks endpoints whose data rarely changes, which are collected
+	// every -scrape.slow-interval rather than on every scrape.
+	slow bool
+
+	enabled *bool
+}
+
+// collectors lists every metric group the exporter knows about. Cheap, core
+// endpoints are enabled by default; larger or more niche ones are opt-in.
+var collectors = []*collector{
+	{
+		name:      "meters",
+		help:      "Collect per-source power, voltage, current and energy from /api/meters/aggregates (one small request per scrape).",
+		isDefault: true,
+		collect:   collectMeters,
+	},
+	{
+		name:      "soe",
+		help:      "Collect battery state of energy from /api/system_status/soe (one tiny request per scrape).",
+		isDefault: true,
+		collect:   collectStateOfEnergy,
+	},
+	{
+		name:      "grid_status",
+		help:      "Collect grid connection status from /api/system_status/grid_status (one tiny request per scrape).",
+		isDefault: true,
+		collect:   collectGridStatus,
+	},
+	{
+		name:      "operation",
+		help:      "Collect operation mode and backup reserve from /api/operation (one tiny request per scrape).",
+		isDefault: false,
+		collect:   collectOperation,
+	},
+	{
+		name:      "sitemaster",
+		help:      "Collect site master running and Tesla connectivity state from /api/sitemaster (one tiny request per scrape).",
+		isDefault: false,
+		collect:   collectSitemaster,
+	},
+	{
+		name:      "status",
+		help:      "Collect firmware version, start time and uptime from /api/status (one tiny request per scrape).",
+		isDefault: false,
+		collect:   collectStatus,
+	},
+	{
+		name:      "gateway_health",
+		help:      "Collect gateway load, disk and memory usage from /api/status, on the firmware that reports them (one tiny request per scrape).",
+		isDefault: false,
+		collect:   collectGatewayHealth,
+	},
+	{
+		name:      "grid_code",
+		help:      "Collect the configured grid code and its nominal voltage and frequency from /api/site_info (one small request per hour).",
+		isDefault: false,
+		collect:   collectGridCode,
+	},
+	{
+		name:      "registration",
+		help:      "Collect whether the gateway is registered to an owner from /api/customer/registration (one tiny request per scrape).",
+		isDefault: false,
+		collect:   collectRegistration,
+		slow:      true,
+	},
+	{
+		name:      "solars",
+		help:      "Collect connected solar inverters from /api/solars (one tiny request per scrape).",
+		isDefault: false,
+		collect:   collectSolars,
+		slow:      true,
+	},
+	{
+		name:      "system_status",
+		help:      "Collect battery capacity and block counts from /api/system_status (large response, noticeably slower on the gateway).",
+		isDefault: false,
+		collect:   collectSystemStatus,
+		slow:      true,
+	},
+	{
+		name:      "powerwalls",
+		help:      "Collect the number of Powerwalls the gateway can see from /api/powerwalls, and compare it with -powerwalls.expected (one small request per scrape).",
+		isDefault: false,
+		collect:   collectPowerwalls,
+		slow:      true,
+	},
+	{
+		name:      "cloud_compare",
+		help:      "Compare the battery percentage and instant power reported by the Tesla cloud with the gateway's, for targets with a cloud_site in -config.file. Requires -cloud.token-file (one cloud and two local requests per -cloud.compare-interval).",
+		isDefault: false,
+		collect:   collectCloudCompare,
+	},
+	{
+		name:      "battery_blocks",
+		help:      "Collect per-block inverter state and power from /api/system_status (large response, and several series per battery block).",
+		isDefault: false,
+		collect:   collectBatteryBlocks,
+		slow:      true,
+	},
+}
+
+func init() {
+	for _, c := range collectors {
+		c.enabled = flag.Bool(fmt.Sprintf("collect.%s", c.name), c.isDefault, c.help)
+	}
+}
+
+var profile = flag.String("profile", "", "Enable a curated set of collectors: minimal, standard or full. Individual -collect.* flags override it. Leave empty to use each collector's default.")
+
+// profiles maps each -profile to the collectors it enables. "full" enables
+// every collector and so isn't listed.
+var profiles = map[string][]string{
+	"minimal":  {"meters", "soe"},
+	"standard": {"meters", "soe", "grid_status", "operation"},
+}
+
+// applyProfile switches collectors on or off according to name, leaving any
+// that were set explicitly on the command line alone.
+func applyProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+
+	wanted := map[string]bool{}
+	if name == "full" {
+		for _, c := range collectors {
+			wanted[c.name] = true
+		}
+	} else {
+		names, ok := profiles[name]
+		if !ok {
+			return errors.Errorf("unknown profile %q, must be minimal, standard or full", name)
+		}
+		for _, n := range names {
+			wanted[n] = true
+		}
+	}
+
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for _, c := range collectors {
+		if !explicit["collect."+c.name] {
+			*c.enabled = wanted[c.name]
+		}
+	}
+	return nil
+}
+
+// enabledCollectors returns the collectors switched on via -collect.* flags,
+// in the order they are declared.
+func enabledCollectors() []*collector {
+	var enabled []*collector
+	for _, c := range collectors {
+		if *c.enabled {
+			enabled = append(enabled, c)
+		}
+	}
+	return enabled
+}
+
+var probeUnknownCollectors = flag.String("probe.unknown-collectors", "error", "What to do with unknown names in a probe's collect parameter: error rejects the probe with 400, ignore drops them.")
+
+// parseCollectParam turns a probe's comma separated collect parameter into
+// the collectors it names, in declaration order, or nil if it is empty.
+// Collectors disabled by flags can be named too.
+func parseCollectParam(param string) ([]*collector, error) {
+	if strings.TrimSpace(param) == "" {
+		return nil, nil
+	}
+
+	wanted := map[string]bool{}
+	for _, name := range strings.Split(param, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			wanted[name] = true
+		}
+	}
+
+	selected := []*collector{}
+	for _, c := range collectors {
+		if wanted[c.name] {
+			selected = append(selected, c)
+			delete(wanted, c.name)
+		}
+	}
+
+	if len(wanted) > 0 {
+		var unknown []string
+		for name := range wanted {
+			unknown = append(unknown, name)
+		}
+		sort.Strings(unknown)
+		if *probeUnknownCollectors == "error" {
+			return nil, errors.Errorf("unknown collectors in collect parameter: %s", strings.Join(unknown, ", "))
+		}
+		slog.Debug("Ignoring unknown collectors in collect parameter", "collectors", unknown)
+	}
+	if len(selected) == 0 {
+		return nil, errors.New("collect parameter names no known collectors")
+	}
+	return selected, nil
+}
+
+type GridStatus struct {
+	GridStatus         string `json:"grid_status"`
+	GridServicesActive bool   `json:"grid_services_active"`
+
+	// Firmware that explains grid transitions does so under one of these
+	// names; most report none of them.
+	GridStatusReason string `json:"grid_status_reason"`
+	Reason           string `json:"reason"`
+	FaultReason      string `json:"fault_reason"`
+}
+
+// TransitionReason returns why the gateway last changed grid state, or ""
+// if the firmware doesn't say.
+func (g *GridStatus) TransitionReason() string {
+	for _, reason := range []string{g.GridStatusReason, g.Reason, g.FaultReason} {
+		if reason = strings.TrimSpace(reason); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+type Operation struct {
+	RealMode             string  `json:"real_mode"`
+	BackupReservePercent float64 `json:"backup_reserve_percent"`
+}
+
+type Sitemaster struct {
+	Running          bool `json:"running"`
+	ConnectedToTesla bool `json:"connected_to_tesla"`
+}
+
+type SystemStatus struct {
+	NominalFullPackEnergy  float64 `json:"nominal_full_pack_energy"`
+	NominalEnergyRemaining float64 `json:"nominal_energy_remaining"`
+	AvailableBlocks        int     `json:"available_blocks"`
+
+	// BatteryTargetPower is the power the gateway has asked the batteries
+	// for. Not every firmware reports it.
+	BatteryTargetPower *float64 `json:"battery_target_power"`
+
+	// MaxChargePower and MaxDischargePower are the current power limits of
+	// the batteries, which drop when they are cold or nearly full or empty.
+	// Older firmware doesn't report them.
+	MaxChargePower    *float64 `json:"max_charge_power"`
+	MaxDischargePower *float64 `json:"max_discharge_power"`
+
+	BatteryBlocks []BatteryBlock `json:"battery_blocks"`
+}
+
+// BatteryBlock is one Powerwall in /api/system_status.
+type BatteryBlock struct {
+	PackageSerialNumber string  `json:"PackageSerialNumber"`
+	PinvState           string  `json:"pinv_state"`
+	PinvGridState       string  `json:"pinv_grid_state"`
+	POut                float64 `json:"p_out"`
+	QOut                float64 `json:"q_out"`
+}
+
+// Solar is one of the inverters listed by /api/solars.
+type Solar struct {
+	Brand            string  `json:"brand"`
+	Model            string  `json:"model"`
+	PowerRatingWatts float64 `json:"power_rating_watts"`
+}
+
+// GatewayStatus is /api/status, which identifies the gateway and its
+// firmware.
+type GatewayStatus struct {
+	DIN        string `json:"din"`
+	Version    string `json:"version"`
+	DeviceType string `json:"device_type"`
+	StartTime  string `json:"start_time"`
+	UpTime     string `json:"up_time_seconds"`
+}
+
+type SiteInfo struct {
+	SiteName string   `json:"site_name"`
+	Timezone string   `json:"timezone"`
+	GridCode GridCode `json:"grid_code"`
+}
+
+func querySiteInfo(ctx context.Context, host string) (*SiteInfo, error) {
+	info := &SiteInfo{}
+	if err := queryAPI(ctx, host, "/api/site_info", info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func queryGridStatus(ctx context.Context, host string) (*GridStatus, error) {
+	status := &GridStatus{}
+	if err := queryAPI(ctx, host, "/api/system_status/grid_status", status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func queryOperation(ctx context.Context, host string) (*Operation, error) {
+	operation := &Operation{}
+	if err := queryAPI(ctx, host, "/api/operation", operation); err != nil {
+		return nil, err
+	}
+	return operation, nil
+}
+
+func querySitemaster(ctx context.Context, host string) (*Sitemaster, error) {
+	sitemaster := &Sitemaster{}
+	if err := queryAPI(ctx, host, "/api/sitemaster", sitemaster); err != nil {
+		return nil, err
+	}
+	return sitemaster, nil
+}
+
+func querySystemStatus(ctx context.Context, host string) (*SystemStatus, error) {
+	status := &SystemStatus{}
+	if err := queryAPI(ctx, host, "/api/system_status", status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func queryGatewayStatus(ctx context.Context, host string) (*GatewayStatus, error) {
+	status := &GatewayStatus{}
+	if err := queryAPI(ctx, host, "/api/status", status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// querySolars lists the solar inverters known to the gateway. Battery-only
+// installs return an empty list.
+func querySolars(ctx context.Context, host string) ([]Solar, error) {
+	var solars []Solar
+	if err := queryAPI(ctx, host, "/api/solars", &solars); err != nil {
+		return nil, err
+	}
+	return solars, nil
+}
+
+// boolToFloat converts a JSON boolean into a 0/1 gauge value.
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func collectMeters(ctx context.Context, host string, reg *prometheus.Registry) error {
+	if !*sourceTimestamps {
+		_, err := populateMeters(ctx, host, reg)
+		return err
+	}
+
+	inner := prometheus.NewRegistry()
+	status, err := populateMeters(ctx, host, inner)
+	if err != nil {
+		return err
+	}
+	times := map[string]time.Time{}
+	for source, rec := range status.Records() {
+		times[source] = rec.LastCommunicationTime
+	}
+	return reg.Register(timestampedCollector{inner: inner, times: times})
+}
+
+// populateMeters exports everything derived from /api/meters/aggregates to
+// reg and returns the readings it was based on.
+func populateMeters(ctx context.Context, host string, reg *prometheus.Registry) (*PowerwallStatus, error) {
+	status, err := queryMeters(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = populateSource("site", status.Site, reg); err != nil {
+		return nil, err
+	}
+	if err = populateSource("battery", status.Battery, reg); err != nil {
+		return nil, err
+	}
+	if err = populateSource("load", status.Load, reg); err != nil {
+		return nil, err
+	}
+	if err = populateSource("solar", status.Solar, reg); err != nil {
+		return nil, err
+	}
+
+	if err = populateClockSkew(host, reg); err != nil {
+		return nil, err
+	}
+
+	if *energyToday {
+		if err = populateEnergyToday(ctx, host, status, reg); err != nil {
+			return nil, err
+		}
+	}
+
+	if *powerWindowEnabled {
+		recordPowerWindow(host, status)
+	}
+
+	if *backupLoadWindow > 0 {
+		recordLoad(host, status.Load, time.Now())
+	}
+
+	if *derivedMetrics {
+		if err = populateEnergyNet(status, reg); err != nil {
+			return nil, err
+		}
+		if err = populateReactivePowerDirection(status, reg); err != nil {
+			return nil, err
+		}
+		if err = populateBatteryGridCharging(status, reg); err != nil {
+			return nil, err
+		}
+	}
+
+	if *solarCapacityWatts > 0 {
+		if err = populateSolarCapacityFactor(status.Solar, reg); err != nil {
+			return nil, err
+		}
+	}
+
+	if *solarCapacityWatts > 0 && *solarClippingThreshold > 0 {
+		if err = populateSolarClipping(host, status.Solar, reg); err != nil {
+			return nil, err
+		}
+	}
+
+	if *batteryTransitions {
+		if err = populateBatteryTransitions(host, status.Battery, reg); err != nil {
+			return nil, err
+		}
+	}
+
+	if *ctCheck {
+		if err = populateCTCheck(ctx, host, status.Solar, reg); err != nil {
+			return nil, err
+		}
+	}
+
+	return status, nil
+}
+
+// The gateway reports the state of energy to many decimal places, and the
+// jitter in the last few makes graphs noisy and compresses poorly.
+var soeRound = flag.Int("soe.round", -1, "Round the battery percentage to this many decimal places before exporting it. Negative disables rounding.")
+
+// roundTo rounds v to the given number of decimal places.
+func roundTo(v float64, decimals int) float64 {
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(v*scale) / scale
+}
+
+var soeClamp = flag.Bool("soe.clamp", false, "Clamp the battery percentage to 0-100. Gateways sometimes report slightly outside that range while recalibrating; the first out-of-range reading of each excursion is logged.")
+
+// clampSOE limits percentage to 0-100 if -soe.clamp is set, logging when
+// host's readings leave and return to that range so a calibration problem
+// isn't hidden entirely.
+func clampSOE(ctx context.Context, host string, percentage float64) float64 {
+	if !*soeClamp {
+		return percentage
+	}
+
+	outOfRange := percentage < 0 || percentage > 100
+
+	state := stateFor(host)
+	state.mu.Lock()
+	if outOfRange && !state.soeOutOfRange {
+		slog.WarnContext(ctx, "Battery percentage out of range, clamping it", "target", host, "percentage", percentage)
+	} else if !outOfRange && state.soeOutOfRange {
+		slog.InfoContext(ctx, "Battery percentage back in range", "target", host, "percentage", percentage)
+	}
+	state.soeOutOfRange = outOfRange
+	state.mu.Unlock()
+
+	return math.Max(0, math.Min(100, percentage))
+}
+
+var batteryPercentageMetric = defineMetric(metricDef{
+	Name:      "battery_percentage",
+	Type:      "gauge",
+	Unit:      "percent",
+	Help:      "Battery percentage of capacity",
+	Collector: "soe",
+})
+
+func collectStateOfEnergy(ctx context.Context, host string, reg *prometheus.Registry) error {
+	soe, err := queryStateOfEnergy(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	percentage := clampSOE(ctx, host, soe.Percentage)
+	if *soeRound >= 0 {
+		percentage = roundTo(percentage, *soeRound)
+	}
+
+	battery, err := batteryPercentageMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	battery.Set(percentage)
+
+	if *soeDaily {
+		return populateSOEDaily(ctx, host, percentage, reg)
+	}
+
+	return nil
+}
+
+var (
+	gridStatusMetric = defineMetric(metricDef{
+		Name:      "grid_status",
+		Type:      "gauge",
+		Help:      "Current grid connection status, as reported by the gateway",
+		Labels:    []string{"status"},
+		Collector: "grid_status",
+	})
+	gridServicesActiveMetric = defineMetric(metricDef{
+		Name:      "grid_services_active",
+		Type:      "gauge",
+		Help:      "Whether the system is currently providing grid services",
+		Collector: "grid_status",
+	})
+	gridTransitionReasonMetric = defineMetric(metricDef{
+		Name:      "grid_transition_reason_info",
+		Type:      "gauge",
+		Help:      "Latest reason the gateway gave for a grid state change, e.g. an over-voltage fault, always 1; absent until the gateway reports one",
+		Labels:    []string{"reason"},
+		Collector: "grid_status",
+	})
+)
+
+func collectGridStatus(ctx context.Context, host string, reg *prometheus.Registry) error {
+	status, err := queryGridStatus(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	gridStatus, err := gridStatusMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	gridStatus.WithLabelValues(status.GridStatus).Set(1)
+
+	servicesActive, err := gridServicesActiveMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	servicesActive.Set(boolToFloat(status.GridServicesActive))
+
+	// The reason is usually only reported around the transition itself, so
+	// the latest one is remembered for post-outage analysis.
+	state := stateFor(host)
+	state.mu.Lock()
+	if reason := status.TransitionReason(); reason != "" {
+		state.gridTransitionReason = reason
+	}
+	reason := state.gridTransitionReason
+	state.mu.Unlock()
+
+	if reason != "" {
+		transitionReason, err := gridTransitionReasonMetric.gaugeVec(reg)
+		if err != nil {
+			return err
+		}
+		transitionReason.WithLabelValues(reason).Set(1)
+	}
+
+	return nil
+}
+
+var (
+	operationModeMetric = defineMetric(metricDef{
+		Name:      "operation_mode",
+		Type:      "gauge",
+		Help:      "Current operation mode of the system",
+		Labels:    []string{"mode"},
+		Collector: "operation",
+	})
+	backupReservePercentageMetric = defineMetric(metricDef{
+		Name:      "backup_reserve_percentage",
+		Type:      "gauge",
+		Unit:      "percent",
+		Help:      "Battery percentage reserved for backup",
+		Collector: "operation",
+	})
+	operationModeChangesMetric = defineMetric(metricDef{
+		Name:      "operation_mode_changes_total",
+		Type:      "counter",
+		Help:      "Number of times the operation mode has changed, as seen by the exporter",
+		Collector: "operation",
+	})
+)
+
+func collectOperation(ctx context.Context, host string, reg *prometheus.Registry) error {
+	operation, err := queryOperation(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	mode, err := operationModeMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	mode.WithLabelValues(operation.RealMode).Set(1)
+
+	reserve, err := backupReservePercentageMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	reserve.Set(operation.BackupReservePercent)
+
+	changes, err := operationModeChangesMetric.counter(reg)
+	if err != nil {
+		return err
+	}
+
+	state := stateFor(host)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.operationMode != "" && state.operationMode != operation.RealMode {
+		state.operationModeChanges++
+		slog.InfoContext(ctx, "Operation mode changed", "target", host, "from", state.operationMode, "to", operation.RealMode)
+	}
+	state.operationMode = operation.RealMode
+	changes.Add(state.operationModeChanges)
+
+	return nil
+}
+
+var (
+	sitemasterRunningMetric = defineMetric(metricDef{
+		Name:      "sitemaster_running",
+		Type:      "gauge",
+		Help:      "Whether the site master is running",
+		Collector: "sitemaster",
+	})
+	connectedToTeslaMetric = defineMetric(metricDef{
+		Name:      "connected_to_tesla",
+		Type:      "gauge",
+		Help:      "Whether the gateway is connected to Tesla",
+		Collector: "sitemaster",
+	})
+)
+
+func collectSitemaster(ctx context.Context, host string, reg *prometheus.Registry) error {
+	sitemaster, err := querySitemaster(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	running, err := sitemasterRunningMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	running.Set(boolToFloat(sitemaster.Running))
+
+	connected, err := connectedToTeslaMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	connected.Set(boolToFloat(sitemaster.ConnectedToTesla))
+
+	return nil
+}
+
+var (
+	nominalFullPackEnergyMetric = defineMetric(metricDef{
+		Name:      "nominal_full_pack_energy",
+		Type:      "gauge",
+		Unit:      "watt_hours",
+		Help:      "Nominal energy of all batteries when full, in Wh",
+		Collector: "system_status",
+	})
+	nominalEnergyRemainingMetric = defineMetric(metricDef{
+		Name:      "nominal_energy_remaining",
+		Type:      "gauge",
+		Unit:      "watt_hours",
+		Help:      "Nominal energy remaining in all batteries, in Wh",
+		Collector: "system_status",
+	})
+	availableBlocksMetric = defineMetric(metricDef{
+		Name:      "available_blocks",
+		Type:      "gauge",
+		Help:      "Number of battery blocks available",
+		Collector: "system_status",
+	})
+	batteryTargetPowerMetric = defineMetric(metricDef{
+		Name:      "battery_target_power_watts",
+		Type:      "gauge",
+		Unit:      "watts",
+		Help:      "Battery power commanded by the gateway, positive when discharging; absent if the firmware doesn't report it",
+		Collector: "system_status",
+	})
+	maxChargePowerMetric = defineMetric(metricDef{
+		Name:      "max_charge_power_watts",
+		Type:      "gauge",
+		Unit:      "watts",
+		Help:      "Most power the batteries can currently charge at, lower when cold or nearly full; absent if the firmware doesn't report it",
+		Collector: "system_status",
+	})
+	maxDischargePowerMetric = defineMetric(metricDef{
+		Name:      "max_discharge_power_watts",
+		Type:      "gauge",
+		Unit:      "watts",
+		Help:      "Most power the batteries can currently discharge at, lower when cold or nearly empty; absent if the firmware doesn't report it",
+		Collector: "system_status",
+	})
+)
+
+func collectSystemStatus(ctx context.Context, host string, reg *prometheus.Registry) error {
+	status, err := querySystemStatus(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	fullPack, err := nominalFullPackEnergyMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	fullPack.Set(status.NominalFullPackEnergy)
+
+	remaining, err := nominalEnergyRemainingMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	remaining.Set(status.NominalEnergyRemaining)
+
+	if *siEnergy {
+		if err := populateBatteryEnergyJoules(status.NominalFullPackEnergy, status.NominalEnergyRemaining, reg); err != nil {
+			return err
+		}
+	}
+
+	blocks, err := availableBlocksMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	blocks.Set(float64(status.AvailableBlocks))
+
+	if status.BatteryTargetPower != nil {
+		target, err := batteryTargetPowerMetric.gauge(reg)
+		if err != nil {
+			return err
+		}
+		target.Set(*status.BatteryTargetPower)
+	}
+
+	if status.MaxChargePower != nil {
+		maxCharge, err := maxChargePowerMetric.gauge(reg)
+		if err != nil {
+			return err
+		}
+		maxCharge.Set(*status.MaxChargePower)
+	}
+
+	if status.MaxDischargePower != nil {
+		maxDischarge, err := maxDischargePowerMetric.gauge(reg)
+		if err != nil {
+			return err
+		}
+		maxDischarge.Set(*status.MaxDischargePower)
+	}
+
+	if *backupLoadWindow > 0 {
+		if err := populateBackupEstimate(ctx, host, status, reg); err != nil {
+			return err
+		}
+	}
+
+	if *derivedMetrics {
+		return populateSystemStatusDerived(ctx, host, status, reg)
+	}
+
+	return nil
+}
+
+var (
+	solarInverterInfoMetric = defineMetric(metricDef{
+		Name:      "solar_inverter_info",
+		Type:      "gauge",
+		Help:      "Solar inverter known to the gateway, always 1",
+		Labels:    []string{"inverter", "brand", "model"},
+		Collector: "solars",
+	})
+	solarInverterPowerRatingMetric = defineMetric(metricDef{
+		Name:      "solar_inverter_power_rating_watts",
+		Type:      "gauge",
+		Unit:      "watts",
+		Help:      "Rated power of each solar inverter, in watts",
+		Labels:    []string{"inverter"},
+		Collector: "solars",
+	})
+	solarInverterCountMetric = defineMetric(metricDef{
+		Name:      "solar_inverter_count",
+		Type:      "gauge",
+		Help:      "Number of solar inverters known to the gateway",
+		Collector: "solars",
+	})
+)
+
+func collectSolars(ctx context.Context, host string, reg *prometheus.Registry) error {
+	solars, err := querySolars(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	count, err := solarInverterCountMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	count.Set(float64(len(solars)))
+
+	if len(solars) == 0 {
+		return nil
+	}
+
+	info, err := solarInverterInfoMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	rating, err := solarInverterPowerRatingMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	for i, solar := range solars {
+		// Inverters have no ID of their own in the API, so they're
+		// identified by their position in the list.
+		inverter := strconv.Itoa(i)
+		info.WithLabelValues(inverter, solar.Brand, solar.Model).Set(1)
+		rating.WithLabelValues(inverter).Set(solar.PowerRatingWatts)
+	}
+
+	return nil
+}
+
+var (
+	batteryBlockPinvStateMetric = defineMetric(metricDef{
+		Name:      "battery_block_pinv_state",
+		Type:      "gauge",
+		Help:      "Current state of each battery block's inverter, always 1",
+		Labels:    []string{"serial", "state"},
+		Collector: "battery_blocks",
+	})
+	batteryBlockPinvGridStateMetric = defineMetric(metricDef{
+		Name:      "battery_block_pinv_grid_state",
+		Type:      "gauge",
+		Help:      "Current grid compliance state of each battery block's inverter, always 1",
+		Labels:    []string{"serial", "state"},
+		Collector: "battery_blocks",
+	})
+	batteryBlockPowerMetric = defineMetric(metricDef{
+		Name:      "battery_block_power_watts",
+		Type:      "gauge",
+		Unit:      "watts",
+		Help:      "Real power output of each battery block, positive when discharging",
+		Labels:    []string{"serial"},
+		Collector: "battery_blocks",
+	})
+	batteryBlockReactivePowerMetric = defineMetric(metricDef{
+		Name:      "battery_block_reactive_power_var",
+		Type:      "gauge",
+		Unit:      "volt_amperes_reactive",
+		Help:      "Reactive power output of each battery block",
+		Labels:    []string{"serial"},
+		Collector: "battery_blocks",
+	})
+)
+
+func collectBatteryBlocks(ctx context.Context, host string, reg *prometheus.Registry) error {
+	status, err := querySystemStatus(ctx, host)
+	if err != nil {
+		return err
+	}
+	if len(status.BatteryBlocks) == 0 {
+		return nil
+	}
+
+	pinvState, err := batteryBlockPinvStateMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	pinvGridState, err := batteryBlockPinvGridStateMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	power, err := batteryBlockPowerMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	reactivePower, err := batteryBlockReactivePowerMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+
+	for _, block := range status.BatteryBlocks {
+		serial := block.PackageSerialNumber
+		pinvState.WithLabelValues(serial, block.PinvState).Set(1)
+		pinvGridState.WithLabelValues(serial, block.PinvGridState).Set(1)
+		power.WithLabelValues(serial).Set(block.POut)
+		reactivePower.WithLabelValues(serial).Set(block.QOut)
+	}
+
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// firmwares are the firmware versions with recorded responses that need no
+// login.
+var firmwares = []string{"20.49.0", "23.44.0"}
+
+func TestQueryFunctions(t *testing.T) {
+	type want map[string]interface{}
+	tests := []struct {
+		name  string
+		query func(ctx context.Context, host string) (interface{}, error)
+		field func(v interface{}) interface{}
+		want  want
+	}{
+		{
+			name:  "meters",
+			query: func(ctx context.Context, host string) (interface{}, error) { return queryMeters(ctx, host) },
+			field: func(v interface{}) interface{} { return v.(*PowerwallStatus).Site.InstantPower },
+			want:  want{"20.49.0": 1520.25, "23.44.0": -2310.5},
+		},
+		{
+			name:  "soe",
+			query: func(ctx context.Context, host string) (interface{}, error) { return queryStateOfEnergy(ctx, host) },
+			field: func(v interface{}) interface{} { return v.(*StateOfEnergy).Percentage },
+			want:  want{"20.49.0": 54.8, "23.44.0": 81.38916},
+		},
+		{
+			name:  "grid status",
+			query: func(ctx context.Context, host string) (interface{}, error) { return queryGridStatus(ctx, host) },
+			field: func(v interface{}) interface{} { return v.(*GridStatus).GridServicesActive },
+			want:  want{"20.49.0": false, "23.44.0": true},
+		},
+		{
+			name:  "operation",
+			query: func(ctx context.Context, host string) (interface{}, error) { return queryOperation(ctx, host) },
+			field: func(v interface{}) interface{} { return v.(*Operation).RealMode },
+			want:  want{"20.49.0": "self_consumption", "23.44.0": "autonomous"},
+		},
+		{
+			name:  "sitemaster",
+			query: func(ctx context.Context, host string) (interface{}, error) { return querySitemaster(ctx, host) },
+			field: func(v interface{}) interface{} { return v.(*Sitemaster).ConnectedToTesla },
+			want:  want{"20.49.0": true, "23.44.0": true},
+		},
+		{
+			name:  "system status",
+			query: func(ctx context.Context, host string) (interface{}, error) { return querySystemStatus(ctx, host) },
+			field: func(v interface{}) interface{} { return len(v.(*SystemStatus).BatteryBlocks) },
+			want:  want{"20.49.0": 1, "23.44.0": 2},
+		},
+		{
+			name:  "gateway status",
+			query: func(ctx context.Context, host string) (interface{}, error) { return queryGatewayStatus(ctx, host) },
+			field: func(v interface{}) interface{} { return v.(*GatewayStatus).Version },
+			want:  want{"20.49.0": "20.49.0 f9e3a3c5", "23.44.0": "23.44.0 eb113390"},
+		},
+		{
+			name:  "site info",
+			query: func(ctx context.Context, host string) (interface{}, error) { return querySiteInfo(ctx, host) },
+			field: func(v interface{}) interface{} { return v.(*SiteInfo).Timezone },
+			want:  want{"20.49.0": "Australia/Perth", "23.44.0": "Australia/Sydney"},
+		},
+		{
+			name:  "solars",
+			query: func(ctx context.Context, host string) (interface{}, error) { return querySolars(ctx, host) },
+			field: func(v interface{}) interface{} { return v.([]Solar)[0].PowerRatingWatts },
+			want:  want{"20.49.0": 5000.0, "23.44.0": 8200.0},
+		},
+		{
+			name:  "powerwalls",
+			query: func(ctx context.Context, host string) (interface{}, error) { return queryPowerwalls(ctx, host) },
+			field: func(v interface{}) interface{} { return len(v.(*Powerwalls).Powerwalls) },
+			want:  want{"20.49.0": 1, "23.44.0": 2},
+		},
+		{
+			name:  "registration",
+			query: func(ctx context.Context, host string) (interface{}, error) { return queryRegistration(ctx, host) },
+			field: func(v interface{}) interface{} { return v.(*Registration).Registered },
+			want:  want{"20.49.0": true, "23.44.0": true},
+		},
+	}
+
+	for _, firmware := range firmwares {
+		gw := newMockGateway(t, firmware)
+		for _, tt := range tests {
+			v, err := tt.query(context.Background(), gw.target())
+			if err != nil {
+				t.Errorf("%s %s: query failed: %v", firmware, tt.name, err)
+				continue
+			}
+			if got := tt.field(v); got != tt.want[firmware] {
+				t.Errorf("%s %s: got %v, want %v", firmware, tt.name, got, tt.want[firmware])
+			}
+		}
+	}
+}
+
+func TestQueryFunctionsAuthRequired(t *testing.T) {
+	gw := newMockGateway(t, "auth-required")
+
+	if _, err := queryGatewayStatus(context.Background(), gw.target()); err != nil {
+		t.Errorf("queryGatewayStatus failed: %v", err)
+	}
+
+	_, err := queryMeters(context.Background(), gw.target())
+	if err == nil {
+		t.Fatal("queryMeters succeeded against a gateway requiring login")
+	}
+	if reason := errorReason(err); reason != "auth" {
+		t.Errorf("errorReason(%v) = %q, want auth", err, reason)
+	}
+}
+
+func TestCollectors(t *testing.T) {
+	tests := []struct {
+		collector string
+		metric    *metricDef
+		labels    string
+		want      map[string]float64
+	}{
+		{"meters", instantPowerMetric, "source=site", map[string]float64{"20.49.0": 1520.25, "23.44.0": -2310.5}},
+		{"meters", instantReactivePowerMetric, "source=site", map[string]float64{"20.49.0": -92.5, "23.44.0": 45.25}},
+		{"meters", instantApparentPowerMetric, "source=site", map[string]float64{"20.49.0": 1523.06, "23.44.0": 2311}},
+		{"meters", frequencyMetric, "source=load", map[string]float64{"20.49.0": 49.992, "23.44.0": 50.012}},
+		{"meters", energyExportedMetric, "source=solar", map[string]float64{"20.49.0": 3456789.5, "23.44.0": 12345678.5}},
+		{"meters", energyImportedMetric, "source=load", map[string]float64{"20.49.0": 5432109.75, "23.44.0": 9876543.25}},
+		{"meters", instantAverageVoltageMetric, "source=battery", map[string]float64{"20.49.0": 243.4, "23.44.0": 247.1}},
+		{"meters", instantTotalCurrentMetric, "source=battery", map[string]float64{"20.49.0": -4.5, "23.44.0": -12.14}},
+		{"soe", batteryPercentageMetric, "", map[string]float64{"20.49.0": 54.8, "23.44.0": 81.38916}},
+		{"grid_status", gridStatusMetric, "status=SystemGridConnected", map[string]float64{"20.49.0": 1, "23.44.0": 1}},
+		{"grid_status", gridServicesActiveMetric, "", map[string]float64{"20.49.0": 0, "23.44.0": 1}},
+		{"operation", operationModeMetric, "mode=self_consumption", map[string]float64{"20.49.0": 1}},
+		{"operation", operationModeMetric, "mode=autonomous", map[string]float64{"23.44.0": 1}},
+		{"operation", backupReservePercentageMetric, "", map[string]float64{"20.49.0": 24.6, "23.44.0": 20}},
+		{"sitemaster", sitemasterRunningMetric, "", map[string]float64{"20.49.0": 1, "23.44.0": 1}},
+		{"sitemaster", connectedToTeslaMetric, "", map[string]float64{"20.49.0": 1, "23.44.0": 1}},
+		{"status", gatewayUptimeMetric, "", map[string]float64{"20.49.0": 541801.123456789, "23.44.0": 652409.557154207}},
+		{"status", gatewayStartTimeMetric, "", map[string]float64{"20.49.0": 1609711495, "23.44.0": 1705050093}},
+		{"grid_code", gridNominalVoltageMetric, "", map[string]float64{"20.49.0": 230, "23.44.0": 230}},
+		{"grid_code", gridNominalFrequencyMetric, "", map[string]float64{"20.49.0": 50, "23.44.0": 50}},
+		{"registration", registeredMetric, "", map[string]float64{"20.49.0": 1, "23.44.0": 1}},
+		{"solars", solarInverterCountMetric, "", map[string]float64{"20.49.0": 1, "23.44.0": 1}},
+		{"system_status", nominalFullPackEnergyMetric, "", map[string]float64{"20.49.0": 13985, "23.44.0": 27500}},
+		{"system_status", nominalEnergyRemainingMetric, "", map[string]float64{"20.49.0": 7664, "23.44.0": 22382}},
+		{"system_status", availableBlocksMetric, "", map[string]float64{"20.49.0": 1, "23.44.0": 2}},
+		{"system_status", maxChargePowerMetric, "", map[string]float64{"23.44.0": 10000}},
+		{"system_status", batteryTargetPowerMetric, "", map[string]float64{"23.44.0": -3100}},
+		{"powerwalls", countMetric, "", map[string]float64{"20.49.0": 1, "23.44.0": 2}},
+		{"battery_blocks", batteryBlockPowerMetric, "serial=TG000000000011", map[string]float64{"23.44.0": -1500}},
+	}
+
+	for _, firmware := range firmwares {
+		gw := newMockGateway(t, firmware)
+		for _, tt := range tests {
+			c := collectorNamed(t, tt.collector)
+			reg := prometheus.NewRegistry()
+			if err := c.collect(context.Background(), gw.target(), reg); err != nil {
+				t.Errorf("%s %s: collect failed: %v", firmware, tt.collector, err)
+				continue
+			}
+
+			want, present := tt.want[firmware]
+			got, ok := gathered(t, reg, tt.metric.Name)[tt.labels]
+			switch {
+			case ok && !present:
+				t.Errorf("%s %s{%s} = %v, want absent", firmware, tt.metric.Name, tt.labels, got)
+			case present && !ok:
+				t.Errorf("%s %s{%s} missing, want %v", firmware, tt.metric.Name, tt.labels, want)
+			case present && got != want:
+				t.Errorf("%s %s{%s} = %v, want %v", firmware, tt.metric.Name, tt.labels, got, want)
+			}
+		}
+	}
+}
+
+// collectorNamed returns the collector called name.
+func collectorNamed(t *testing.T, name string) *collector {
+	t.Helper()
+	for _, c := range collectors {
+		if c.name == name {
+			return c
+		}
+	}
+	t.Fatalf("no collector called %s", name)
+	return nil
+}
+
+func TestClampSOE(t *testing.T) {
+	tests := []struct {
+		percentage float64
+		clamped    float64
+		outOfRange bool
+	}{
+		{54.8, 54.8, false},
+		{0, 0, false},
+		{100, 100, false},
+		{100.4, 100, true},
+		{-0.5, 0, true},
+		{250, 100, true},
+		{99.9, 99.9, false},
+	}
+
+	const host = "192.0.2.1"
+	t.Cleanup(func() { forgetTarget(host) })
+
+	for _, clamp := range []bool{false, true} {
+		setFlag(t, soeClamp, clamp)
+		for _, tt := range tests {
+			want := tt.percentage
+			if clamp {
+				want = tt.clamped
+			}
+			if got := clampSOE(context.Background(), host, tt.percentage); got != want {
+				t.Errorf("clamp %v: clampSOE(%v) = %v, want %v", clamp, tt.percentage, got, want)
+			}
+			if clamp {
+				state := stateFor(host)
+				state.mu.Lock()
+				outOfRange := state.soeOutOfRange
+				state.mu.Unlock()
+				if outOfRange != tt.outOfRange {
+					t.Errorf("after %v, out of range = %v, want %v", tt.percentage, outOfRange, tt.outOfRange)
+				}
+			}
+		}
+	}
+}
+
+func TestClampSOECollector(t *testing.T) {
+	gw := newMockGateway(t, "23.44.0")
+	gw.set("/api/system_status/soe", mockResponse{contentType: "application/json", body: `{"percentage":100.6}`})
+
+	for _, tt := range []struct {
+		clamp bool
+		want  float64
+	}{
+		{false, 100.6},
+		{true, 100},
+	} {
+		setFlag(t, soeClamp, tt.clamp)
+		reg := prometheus.NewRegistry()
+		if err := collectorNamed(t, "soe").collect(context.Background(), gw.target(), reg); err != nil {
+			t.Fatalf("collect failed: %v", err)
+		}
+		if got := gathered(t, reg, batteryPercentageMetric.Name)[""]; got != tt.want {
+			t.Errorf("clamp %v: %s = %v, want %v", tt.clamp, batteryPercentageMetric.Name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+var configFile = flag.String("config.file", "", "YAML file listing the gateways to scrape in the background. Reloaded on SIGHUP.")
+
+// Config is the contents of -config.file.
+type Config struct {
+	Targets []TargetConfig `yaml:"targets"`
+}
+
+// TargetConfig configures a single gateway.
+type TargetConfig struct {
+	Address string `yaml:"address"`
+	// Labels are added to every metric scraped from the gateway.
+	Labels map[string]string `yaml:"labels"`
+	// Collectors, if set, replaces the collectors enabled by -profile and
+	// -collect.* for this gateway.
+	Collectors []string `yaml:"collectors"`
+	// Sources, if set, limits metrics with a source label to these
+	// sources, e.g. to drop solar on a site without panels.
+	Sources []string `yaml:"sources"`
+	// ExpectedPowerwalls, if set, overrides -powerwalls.expected.
+	ExpectedPowerwalls int `yaml:"expected_powerwalls"`
+	// CloudSite is the gateway's energy site ID in the Tesla cloud, for
+	// -collect.cloud_compare.
+	CloudSite string `yaml:"cloud_site"`
+}
+
+// reservedLabels can't be set in a target's labels: Prometheus sets
+// instance and job itself, and target is added to combined probes.
+var reservedLabels = map[string]bool{
+	"instance":  true,
+	"job":       true,
+	targetLabel: true,
+}
+
+var (
+	configMu sync.RWMutex
+	config   *Config
+)
+
+var (
+	configReloadSuccess = defineMetric(metricDef{
+		Name:     "config_last_reload_success",
+		Type:     "gauge",
+		Help:     "Whether the last configuration reload succeeded",
+		Path:     "/metrics",
+		Requires: "-config.file",
+	}).newGauge()
+	configReloadTimestamp = defineMetric(metricDef{
+		Name:     "config_last_reload_timestamp_seconds",
+		Type:     "gauge",
+		Unit:     "seconds",
+		Help:     "Timestamp of the last successful configuration reload",
+		Path:     "/metrics",
+		Requires: "-config.file",
+	}).newGauge()
+)
+
+func init() {
+	prometheus.MustRegister(configReloadSuccess)
+	prometheus.MustRegister(configReloadTimestamp)
+}
+
+func loadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config file")
+	}
+
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, errors.Wrap(err, "parsing config file")
+	}
+	if err := c.validate(); err != nil {
+		return nil, errors.Wrap(err, "validating config file")
+	}
+
+	return c, nil
+}
+
+func (c *Config) validate() error {
+	seen := map[string]bool{}
+	for i, t := range c.Targets {
+		if strings.TrimSpace(t.Address) == "" {
+			return errors.Errorf("target %d has no address", i+1)
+		}
+		address := normalizeTarget(t.Address)
+		if seen[address] {
+			return errors.Errorf("target %s is listed more than once", t.Address)
+		}
+		seen[address] = true
+
+		if err := validateTargetLabels(t.Labels); err != nil {
+			return errors.Wrapf(err, "target %s", t.Address)
+		}
+		if err := t.validateOverrides(); err != nil {
+			return errors.Wrapf(err, "target %s", t.Address)
+		}
+	}
+	return nil
+}
+
+// validateOverrides checks a target's collectors and sources name things
+// the exporter knows about, and that its expected Powerwall count and
+// cloud site make sense.
+func (t TargetConfig) validateOverrides() error {
+	if _, ok := cloudSite(normalizeTarget(t.Address)); ok {
+		if len(t.Collectors) > 0 {
+			return errors.New("collectors can't be set for cloud targets")
+		}
+		if t.ExpectedPowerwalls != 0 {
+			return errors.New("expected_powerwalls can't be set for cloud targets")
+		}
+		if t.CloudSite != "" {
+			return errors.New("cloud_site can't be set for cloud targets")
+		}
+	}
+	if t.ExpectedPowerwalls < 0 {
+		return errors.Errorf("expected_powerwalls must not be negative, got %d", t.ExpectedPowerwalls)
+	}
+
+	known := map[string]bool{}
+	for _, c := range collectors {
+		known[c.name] = true
+	}
+	for _, name := range t.Collectors {
+		if !known[name] {
+			return errors.Errorf("unknown collector %q", name)
+		}
+	}
+
+	for _, source := range t.Sources {
+		if !isSource(source) {
+			return errors.Errorf("unknown source %q, must be one of %s", source, strings.Join(Sources, ", "))
+		}
+	}
+	return nil
+}
+
+// isSource reports whether name is one of Sources.
+func isSource(name string) bool {
+	for _, source := range Sources {
+		if source == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateTargetLabels checks that labels are valid and can't collide with
+// labels the exporter or Prometheus set.
+func validateTargetLabels(labels map[string]string) error {
+	metricLabels := map[string]bool{}
+	for _, d := range catalog {
+		for _, l := range d.Labels {
+			metricLabels[l] = true
+		}
+	}
+
+	for name, value := range labels {
+		switch {
+		case !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__"):
+			return errors.Errorf("invalid label name %q", name)
+		case reservedLabels[name]:
+			return errors.Errorf("label %q is reserved", name)
+		case metricLabels[name]:
+			return errors.Errorf("label %q is already used by the exporter's metrics", name)
+		case value == "" || !model.LabelValue(value).IsValid():
+			return errors.Errorf("invalid value %q for label %q", value, name)
+		}
+	}
+	return nil
+}
+
+// targetConfig returns the configuration of target, or nil if it isn't in
+// -config.file.
+func targetConfig(target string) *TargetConfig {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	if config == nil {
+		return nil
+	}
+	for i, t := range config.Targets {
+		if normalizeTarget(t.Address) == target {
+			return &config.Targets[i]
+		}
+	}
+	return nil
+}
+
+// targetLabels returns the labels configured for target, if any.
+func targetLabels(target string) map[string]string {
+	if t := targetConfig(target); t != nil {
+		return t.Labels
+	}
+	return nil
+}
+
+// targetCollectors returns the collectors to run for target: those listed
+// for it in -config.file, or else the ones enabled by flags.
+func targetCollectors(target string) []*collector {
+	t := targetConfig(target)
+	if t == nil || len(t.Collectors) == 0 {
+		return enabledCollectors()
+	}
+
+	wanted := map[string]bool{}
+	for _, name := range t.Collectors {
+		wanted[name] = true
+	}
+	var enabled []*collector
+	for _, c := range collectors {
+		if wanted[c.name] {
+			enabled = append(enabled, c)
+		}
+	}
+	return enabled
+}
+
+// targetSources returns the sources configured for target, or nil to keep
+// every source.
+func targetSources(target string) []string {
+	if t := targetConfig(target); t != nil {
+		return t.Sources
+	}
+	return nil
+}
+
+// addresses returns the address of every configured target.
+func (c *Config) addresses() []string {
+	var addresses []string
+	for _, t := range c.Targets {
+		addresses = append(addresses, normalizeTarget(t.Address))
+	}
+	return addresses
+}
+
+// reloadConfig loads -config.file and, only if it is valid, swaps it in and
+// points the background scraper at its targets. A bad file leaves the
+// running configuration untouched.
+func reloadConfig() error {
+	c, err := loadConfig(*configFile)
+	if err != nil {
+		configReloadSuccess.Set(0)
+		return err
+	}
+
+	configMu.Lock()
+	config = c
+	configMu.Unlock()
+
+	scraper.setTargets(c.addresses())
+
+	configReloadSuccess.Set(1)
+	configReloadTimestamp.SetToCurrentTime()
+	return nil
+}
+
+// watchConfigReloads reloads the configuration every time the process
+// receives SIGHUP.
+func watchConfigReloads() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if err := reloadConfig(); err != nil {
+			slog.Error("Reloading configuration failed, keeping the previous one", "file", *configFile, "error", err)
+			continue
+		}
+		slog.Info("Reloaded configuration", "file", *configFile)
+	}
+}
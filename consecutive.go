@@ -0,0 +1,49 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	consecutiveFailures = defineMetric(metricDef{
+		Name:   "consecutive_failures",
+		Type:   "gauge",
+		Help:   "Number of scrapes of the target that have failed in a row, 0 after a success",
+		Labels: []string{"target"},
+		Path:   "/metrics",
+	}).newGaugeVec()
+	consecutiveSuccesses = defineMetric(metricDef{
+		Name:   "consecutive_successes",
+		Type:   "gauge",
+		Help:   "Number of scrapes of the target that have succeeded in a row, 0 after a failure",
+		Labels: []string{"target"},
+		Path:   "/metrics",
+	}).newGaugeVec()
+)
+
+func init() {
+	prometheus.MustRegister(consecutiveFailures)
+	prometheus.MustRegister(consecutiveSuccesses)
+}
+
+// recordScrapeOutcome updates the run of successful or failed scrapes of
+// target. Runs are counted per scrape rather than over a time window, so
+// alerts like "down for 3 scrapes" hold whatever the scrape interval.
+func recordScrapeOutcome(target string, err error) {
+	state := stateFor(target)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	state.lastScrape = time.Now()
+	if err != nil {
+		state.consecutiveFailures++
+		state.consecutiveSuccesses = 0
+	} else {
+		state.consecutiveSuccesses++
+		state.consecutiveFailures = 0
+	}
+	consecutiveFailures.WithLabelValues(target).Set(float64(state.consecutiveFailures))
+	consecutiveSuccesses.WithLabelValues(target).Set(float64(state.consecutiveSuccesses))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ctCheck              = flag.Bool("ct-check.enabled", false, "Flag solar CT clamps that look to be installed backwards. Relies on per-target state; use background scraping for reliable results.")
+	ctCheckThreshold     = flag.Float64("ct-check.threshold-watts", 100, "Solar power more negative than this counts as reversed.")
+	ctCheckSamples       = flag.Int("ct-check.samples", 20, "Consecutive daylight samples below -ct-check.threshold-watts needed before flagging.")
+	ctCheckDaylightStart = flag.Int("ct-check.daylight-start-hour", 10, "Local hour from which solar production is expected.")
+	ctCheckDaylightEnd   = flag.Int("ct-check.daylight-end-hour", 15, "Local hour until which solar production is expected.")
+)
+
+var possibleCTReversedMetric = defineMetric(metricDef{
+	Name:      "possible_ct_reversed",
+	Type:      "gauge",
+	Help:      "Whether the source's CT clamp looks to be installed backwards",
+	Labels:    []string{"source"},
+	Collector: "meters",
+	Requires:  "-ct-check.enabled",
+})
+
+// populateCTCheck flags a likely reversed solar CT clamp. A backwards clamp
+// makes production read as consumption, so solar power that stays clearly
+// negative through the middle of the day is a strong hint. Only daylight
+// samples count either way; at night a small negative reading is normal.
+func populateCTCheck(ctx context.Context, host string, solar Record, reg *prometheus.Registry) error {
+	reversed, err := possibleCTReversedMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+
+	hour := time.Now().In(timezone(ctx, host)).Hour()
+
+	state := stateFor(host)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if hour >= *ctCheckDaylightStart && hour < *ctCheckDaylightEnd {
+		if solar.InstantPower < -*ctCheckThreshold {
+			state.negativeSolarSamples++
+		} else {
+			state.negativeSolarSamples = 0
+		}
+	}
+
+	reversed.WithLabelValues("solar").Set(boolToFloat(state.negativeSolarSamples >= *ctCheckSamples))
+
+	return nil
+}
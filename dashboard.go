@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// The dashboard is generated from the catalog on every request rather than
+// shipped as a file, so it always uses the names this exporter emits, after
+// -metric.name-template and with only the enabled collectors and options.
+
+// grafanaDashboard is the subset of Grafana's dashboard JSON model we use.
+type grafanaDashboard struct {
+	Inputs        []grafanaInput `json:"__inputs"`
+	Title         string         `json:"title"`
+	UID           string         `json:"uid"`
+	SchemaVersion int            `json:"schemaVersion"`
+	Time          grafanaRange   `json:"time"`
+	Templating    struct {
+		List []grafanaVariable `json:"list"`
+	} `json:"templating"`
+	Panels []grafanaPanel `json:"panels"`
+}
+
+type grafanaInput struct {
+	Name     string `json:"name"`
+	Label    string `json:"label"`
+	Type     string `json:"type"`
+	PluginID string `json:"pluginId"`
+}
+
+type grafanaRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type grafanaVariable struct {
+	Name       string            `json:"name"`
+	Label      string            `json:"label"`
+	Type       string            `json:"type"`
+	Datasource string            `json:"datasource"`
+	Query      string            `json:"query"`
+	Multi      bool              `json:"multi"`
+	IncludeAll bool              `json:"includeAll"`
+	Refresh    int               `json:"refresh"`
+	Current    map[string]string `json:"current"`
+}
+
+type grafanaPanel struct {
+	ID          int                `json:"id"`
+	Type        string             `json:"type"`
+	Title       string             `json:"title"`
+	Description string             `json:"description"`
+	Datasource  string             `json:"datasource"`
+	GridPos     grafanaGridPos     `json:"gridPos"`
+	Targets     []grafanaTarget    `json:"targets"`
+	FieldConfig grafanaFieldConfig `json:"fieldConfig"`
+}
+
+type grafanaGridPos struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+type grafanaTarget struct {
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+	RefID        string `json:"refId"`
+}
+
+type grafanaFieldConfig struct {
+	Defaults struct {
+		Unit string `json:"unit,omitempty"`
+	} `json:"defaults"`
+}
+
+// grafanaUnits maps catalog units to Grafana's unit IDs.
+var grafanaUnits = map[string]string{
+	"watts":                 "watt",
+	"volt_amperes":          "voltamp",
+	"volt_amperes_reactive": "voltampreact",
+	"watt_hours":            "watth",
+	"kilowatt_hours":        "kwatth",
+	"joules":                "joule",
+	"hertz":                 "hertz",
+	"volts":                 "volt",
+	"amperes":               "amp",
+	"percent":               "percent",
+	"seconds":               "s",
+	"hours":                 "h",
+}
+
+// buildDashboard creates a panel for every gateway metric the exporter
+// will currently emit.
+func buildDashboard() *grafanaDashboard {
+	enabled := map[string]bool{}
+	for _, c := range enabledCollectors() {
+		enabled[c.name] = true
+	}
+
+	var defs []*metricDef
+	for _, d := range catalog {
+		if d.Path != "/probe" || !requirementMet(d.Requires) {
+			continue
+		}
+		if d.Collector != "" && !enabled[d.Collector] {
+			continue
+		}
+		defs = append(defs, d)
+	}
+	sort.Slice(defs, func(i, j int) bool {
+		return defs[i].Name < defs[j].Name
+	})
+
+	dash := &grafanaDashboard{
+		Inputs: []grafanaInput{{
+			Name:     "DS_PROMETHEUS",
+			Label:    "Prometheus",
+			Type:     "datasource",
+			PluginID: "prometheus",
+		}},
+		Title:         "Tesla Powerwall",
+		UID:           "powerwall-exporter",
+		SchemaVersion: 27,
+		Time:          grafanaRange{From: "now-24h", To: "now"},
+	}
+	dash.Templating.List = []grafanaVariable{{
+		Name:       "instance",
+		Label:      "Gateway",
+		Type:       "query",
+		Datasource: "${DS_PROMETHEUS}",
+		Query:      fmt.Sprintf("label_values(%s, instance)", metricsCollectedMetric.Name),
+		Multi:      true,
+		IncludeAll: true,
+		Refresh:    2,
+		Current:    map[string]string{"text": "All", "value": "$__all"},
+	}}
+
+	for i, d := range defs {
+		expr := fmt.Sprintf(`%s{instance=~"$instance"}`, d.Name)
+		if d.Type == "counter" {
+			expr = fmt.Sprintf("rate(%s[5m])", expr)
+		}
+
+		legend := []string{"{{instance}}"}
+		for _, l := range d.Labels {
+			legend = append(legend, fmt.Sprintf("{{%s}}", l))
+		}
+
+		panel := grafanaPanel{
+			ID:          i + 1,
+			Type:        "timeseries",
+			Title:       d.Name,
+			Description: d.Help,
+			Datasource:  "${DS_PROMETHEUS}",
+			GridPos:     grafanaGridPos{X: (i % 2) * 12, Y: (i / 2) * 8, W: 12, H: 8},
+			Targets: []grafanaTarget{{
+				Expr:         expr,
+				LegendFormat: strings.Join(legend, " "),
+				RefID:        "A",
+			}},
+		}
+		if d.Type != "counter" {
+			panel.FieldConfig.Defaults.Unit = grafanaUnits[d.Unit]
+		}
+		dash.Panels = append(dash.Panels, panel)
+	}
+
+	return dash
+}
+
+// dashboardHandler serves a Grafana dashboard for the metrics this
+// exporter emits, ready to import.
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(buildDashboard()); err != nil {
+		slog.Error("Writing dashboard failed", "error", err)
+	}
+}
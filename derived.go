@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var derivedMetrics = flag.Bool("metrics.derived", false, "Export metrics the exporter calculates from gateway readings, such as battery time to full and empty. Some need an extra request per scrape.")
+
+// The battery and site meters both report a few tens of watts of noise, so
+// grid charging is only flagged above these thresholds.
+var (
+	gridChargingMinCharge = flag.Float64("grid-charging.min-charge-watts", 100, "Battery charge power, in W, above which -metrics.derived can flag the battery as charging from the grid.")
+	gridChargingMinImport = flag.Float64("grid-charging.min-import-watts", 100, "Grid power going into the battery, in W, above which -metrics.derived flags the battery as charging from the grid.")
+)
+
+var (
+	timeToEmptyMetric = defineMetric(metricDef{
+		Name:      "time_to_empty_hours",
+		Type:      "gauge",
+		Unit:      "hours",
+		Help:      "Hours until the batteries are empty at the current discharge rate, ignoring the backup reserve; absent unless discharging",
+		Collector: "system_status",
+		Requires:  "-metrics.derived",
+	})
+	timeToFullMetric = defineMetric(metricDef{
+		Name:      "time_to_full_hours",
+		Type:      "gauge",
+		Unit:      "hours",
+		Help:      "Hours until the batteries are full at the current charge rate; absent unless charging",
+		Collector: "system_status",
+		Requires:  "-metrics.derived",
+	})
+	energyNetMetric = defineMetric(metricDef{
+		Name:      "energy_net_wh",
+		Type:      "gauge",
+		Unit:      "watt_hours",
+		Help:      "Lifetime energy exported minus energy imported by source, in Wh; can go down as well as up",
+		Labels:    []string{"source"},
+		Collector: "meters",
+		Requires:  "-metrics.derived",
+	})
+	reactivePowerDirectionMetric = defineMetric(metricDef{
+		Name:      "reactive_power_vars",
+		Type:      "gauge",
+		Unit:      "volt_amperes_reactive",
+		Help:      "Magnitude of each source's instant reactive power by direction, lagging for positive readings and leading for negative ones; the other direction is 0",
+		Labels:    []string{"source", "direction"},
+		Collector: "meters",
+		Requires:  "-metrics.derived",
+	})
+	batteryGridChargingMetric = defineMetric(metricDef{
+		Name:      "battery_grid_charging",
+		Type:      "gauge",
+		Help:      "Whether the battery is charging from the grid: 1 while it charges faster than -grid-charging.min-charge-watts and more than -grid-charging.min-import-watts of that comes from the grid",
+		Collector: "meters",
+		Requires:  "-metrics.derived",
+	})
+	batteryGridChargingPowerMetric = defineMetric(metricDef{
+		Name:      "battery_grid_charging_watts",
+		Type:      "gauge",
+		Unit:      "watts",
+		Help:      "Battery charge power supplied by the grid, counting solar as serving the load first; 0 unless the battery is charging while the site imports",
+		Collector: "meters",
+		Requires:  "-metrics.derived",
+	})
+	batteryPowerShortfallMetric = defineMetric(metricDef{
+		Name:      "battery_power_shortfall_watts",
+		Type:      "gauge",
+		Unit:      "watts",
+		Help:      "How far the battery's actual power falls short of the power commanded by the gateway; absent if the firmware doesn't report the commanded power",
+		Collector: "system_status",
+		Requires:  "-metrics.derived",
+	})
+	soeCalibrationDeltaMetric = defineMetric(metricDef{
+		Name:      "soe_calibration_delta_percent",
+		Type:      "gauge",
+		Unit:      "percent",
+		Help:      "Reported state of energy minus nominal energy remaining as a percentage of nominal full pack energy; a growing gap can mean calibration drift",
+		Collector: "system_status",
+		Requires:  "-metrics.derived",
+	})
+)
+
+// idleBatteryWatts is the battery power below which the battery is treated
+// as idle. The gateway reports a few tens of watts either way even when the
+// battery is doing nothing, which would give estimates of weeks.
+const idleBatteryWatts = 50
+
+// populateSystemStatusDerived exports the derived metrics that combine
+// /api/system_status with the battery's actual power from the meters, which
+// report it positive while discharging and negative while charging.
+func populateSystemStatusDerived(ctx context.Context, host string, status *SystemStatus, reg *prometheus.Registry) error {
+	meters, err := queryMeters(ctx, host)
+	if err != nil {
+		return err
+	}
+	power := meters.Battery.InstantPower
+
+	if status.BatteryTargetPower != nil {
+		if err := populateBatteryShortfall(*status.BatteryTargetPower, power, reg); err != nil {
+			return err
+		}
+	}
+	if !nominalEnergyKnown(ctx, host, status, "time to empty and full, SOE calibration delta") {
+		return nil
+	}
+	if err := populateBatteryTimes(status, power, reg); err != nil {
+		return err
+	}
+
+	soe, err := queryStateOfEnergy(ctx, host)
+	if err != nil {
+		return err
+	}
+	return populateSOECalibrationDelta(soe.Percentage, status, reg)
+}
+
+// nominalEnergyKnown reports whether status has the nominal full pack
+// energy that the battery metrics derived from it are measured against.
+// Some firmware reports it as zero, or leaves it out, for a while after
+// booting. Estimates based on it would then be zero or infinite rather than
+// missing, so they are left out of that scrape, and the metrics named in
+// skipped are logged at debug.
+func nominalEnergyKnown(ctx context.Context, host string, status *SystemStatus, skipped string) bool {
+	if status.NominalFullPackEnergy > 0 {
+		return true
+	}
+	slog.DebugContext(ctx, "Gateway reported no nominal full pack energy, skipping metrics derived from it", "target", host, "skipped", skipped, "nominal_full_pack_energy", status.NominalFullPackEnergy, "nominal_energy_remaining", status.NominalEnergyRemaining)
+	return false
+}
+
+// populateSOECalibrationDelta exports how far the gateway's state of energy
+// is from the one implied by its energy figures. The two are computed
+// separately by the battery management system and normally track each other
+// closely.
+func populateSOECalibrationDelta(soe float64, status *SystemStatus, reg *prometheus.Registry) error {
+	delta, err := soeCalibrationDeltaMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	delta.Set(soe - status.NominalEnergyRemaining/status.NominalFullPackEnergy*100)
+	return nil
+}
+
+// batteryShortfall is how much less power the battery is delivering than it
+// was asked for, in the commanded direction. It is zero when the battery
+// meets or exceeds the target, and at most the target itself.
+func batteryShortfall(target float64, actual float64) float64 {
+	if target == 0 {
+		return 0
+	}
+	sign := math.Copysign(1, target)
+	return math.Min(math.Abs(target), math.Max(0, (target-actual)*sign))
+}
+
+// populateBatteryShortfall exports the gap between commanded and actual
+// battery power. A persistent gap means the battery can't keep up, e.g.
+// because it is cold, nearly full or at its power limit.
+func populateBatteryShortfall(target float64, actual float64, reg *prometheus.Registry) error {
+	shortfall, err := batteryPowerShortfallMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	shortfall.Set(batteryShortfall(target, actual))
+	return nil
+}
+
+// populateBatteryTimes exports how long the batteries will take to empty or
+// fill at the current rate.
+func populateBatteryTimes(status *SystemStatus, power float64, reg *prometheus.Registry) error {
+	if math.Abs(power) < idleBatteryWatts {
+		return nil
+	}
+
+	if power > 0 {
+		empty, err := timeToEmptyMetric.gauge(reg)
+		if err != nil {
+			return err
+		}
+		empty.Set(math.Max(0, status.NominalEnergyRemaining) / power)
+		return nil
+	}
+
+	full, err := timeToFullMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	full.Set(math.Max(0, status.NominalFullPackEnergy-status.NominalEnergyRemaining) / -power)
+	return nil
+}
+
+// populateReactivePowerDirection splits each source's signed reactive power
+// into a lagging (inductive) and a leading (capacitive) magnitude. Both are
+// always present so each series stays continuous as the sign flips. Stale
+// sources are left out, like their instant readings.
+func populateReactivePowerDirection(status *PowerwallStatus, reg *prometheus.Registry) error {
+	reactive, err := reactivePowerDirectionMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	for source, rec := range status.Records() {
+		if *freshnessMaxAge > 0 && sourceStale(rec) {
+			continue
+		}
+		q := rec.InstantReactivePower
+		reactive.WithLabelValues(source, "lagging").Set(math.Max(0, q))
+		reactive.WithLabelValues(source, "leading").Set(math.Max(0, -q))
+	}
+	return nil
+}
+
+// gridChargingPower is how much of the battery's charge power comes from the
+// grid, given the battery's power (negative while charging) and the site's
+// (positive while importing). Solar is counted as serving the load before
+// the battery, so with site = load - solar - battery, the grid's share is
+// whichever of the charge power and the import is smaller.
+func gridChargingPower(battery float64, site float64) float64 {
+	if battery >= 0 || site <= 0 {
+		return 0
+	}
+	return math.Min(-battery, site)
+}
+
+// populateBatteryGridCharging exports whether, and how hard, the battery is
+// charging from the grid. Nothing is exported while either meter is stale.
+func populateBatteryGridCharging(status *PowerwallStatus, reg *prometheus.Registry) error {
+	if *freshnessMaxAge > 0 && (sourceStale(status.Battery) || sourceStale(status.Site)) {
+		return nil
+	}
+
+	power := gridChargingPower(status.Battery.InstantPower, status.Site.InstantPower)
+
+	watts, err := batteryGridChargingPowerMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	watts.Set(power)
+
+	charging, err := batteryGridChargingMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	charging.Set(boolToFloat(-status.Battery.InstantPower > *gridChargingMinCharge && power > *gridChargingMinImport))
+	return nil
+}
+
+// populateEnergyNet exports each source's net energy. Subtracting the two
+// counters here, from the same reading, avoids the mismatched counter resets
+// that make doing it in PromQL error-prone.
+func populateEnergyNet(status *PowerwallStatus, reg *prometheus.Registry) error {
+	net, err := energyNetMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	for source, rec := range status.Records() {
+		net.WithLabelValues(source).Set(rec.EnergyExported - rec.EnergyImported)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNominalEnergyKnown(t *testing.T) {
+	for _, tt := range []struct {
+		fullPack float64
+		want     bool
+	}{
+		{27500, true},
+		{0.5, true},
+		{0, false},
+		{-1, false},
+	} {
+		status := &SystemStatus{NominalFullPackEnergy: tt.fullPack}
+		if got := nominalEnergyKnown(context.Background(), "192.0.2.1", status, "test"); got != tt.want {
+			t.Errorf("nominalEnergyKnown(%v) = %v, want %v", tt.fullPack, got, tt.want)
+		}
+	}
+}
+
+// TestSystemStatusDerivedZeroFullPack checks that the battery metrics
+// measured against the nominal full pack energy are left out, rather than
+// exported as zero or infinite, while the gateway reports it as zero.
+func TestSystemStatusDerivedZeroFullPack(t *testing.T) {
+	gw := newMockGateway(t, "23.44.0")
+	target := -3100.0
+
+	for _, tt := range []struct {
+		fullPack float64
+		present  bool
+	}{
+		{27500, true},
+		{0, false},
+	} {
+		status := &SystemStatus{
+			NominalFullPackEnergy:  tt.fullPack,
+			NominalEnergyRemaining: 22382,
+			BatteryTargetPower:     &target,
+		}
+		reg := prometheus.NewRegistry()
+		if err := populateSystemStatusDerived(context.Background(), gw.target(), status, reg); err != nil {
+			t.Fatalf("full pack %v: populateSystemStatusDerived failed: %v", tt.fullPack, err)
+		}
+
+		for _, m := range []*metricDef{timeToFullMetric, soeCalibrationDeltaMetric} {
+			if _, ok := gathered(t, reg, m.Name)[""]; ok != tt.present {
+				t.Errorf("full pack %v: %s present %v, want %v", tt.fullPack, m.Name, ok, tt.present)
+			}
+		}
+		// The shortfall doesn't depend on it, so it stays.
+		if _, ok := gathered(t, reg, batteryPowerShortfallMetric.Name)[""]; !ok {
+			t.Errorf("full pack %v: %s missing", tt.fullPack, batteryPowerShortfallMetric.Name)
+		}
+	}
+}
+
+func TestBackupEstimateZeroFullPack(t *testing.T) {
+	setFlag(t, backupLoadWindow, time.Hour)
+	gw := newMockGateway(t, "23.44.0")
+	recordLoad(gw.target(), Record{InstantPower: 1500}, time.Now())
+
+	for _, tt := range []struct {
+		fullPack float64
+		present  bool
+	}{
+		{27500, true},
+		{0, false},
+	} {
+		status := &SystemStatus{NominalFullPackEnergy: tt.fullPack, NominalEnergyRemaining: 22382}
+		reg := prometheus.NewRegistry()
+		if err := populateBackupEstimate(context.Background(), gw.target(), status, reg); err != nil {
+			t.Fatalf("full pack %v: populateBackupEstimate failed: %v", tt.fullPack, err)
+		}
+		for _, m := range []*metricDef{estimatedBackupHoursMetric, backupLoadMetric} {
+			if _, ok := gathered(t, reg, m.Name)[""]; ok != tt.present {
+				t.Errorf("full pack %v: %s present %v, want %v", tt.fullPack, m.Name, ok, tt.present)
+			}
+		}
+	}
+}
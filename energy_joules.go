@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Pipelines that normalise on SI base units want energy in joules rather
+// than the Wh the gateway reports, so the energy metrics can also be
+// exported in joules under names that make the unit explicit. This is
+// independent of -metrics.energy-kwh; both may be on at once.
+var siEnergy = flag.Bool("metrics.si-energy", false, "Also export the energy metrics in joules (1 Wh = 3600 J), under names ending in _joules.")
+
+// joulesPerWattHour converts the gateway's Wh to joules.
+const joulesPerWattHour = 3600
+
+var (
+	energyExportedJoulesMetric = defineMetric(metricDef{
+		Name:      "energy_exported_joules",
+		Type:      "gauge",
+		Unit:      "joules",
+		Help:      "Lifetime energy exported by source, in joules (the gateway reports Wh; see energy_exported)",
+		Labels:    []string{"source"},
+		Collector: "meters",
+		Requires:  "-metrics.si-energy",
+	})
+	energyImportedJoulesMetric = defineMetric(metricDef{
+		Name:      "energy_imported_joules",
+		Type:      "gauge",
+		Unit:      "joules",
+		Help:      "Lifetime energy imported by source, in joules (the gateway reports Wh; see energy_imported)",
+		Labels:    []string{"source"},
+		Collector: "meters",
+		Requires:  "-metrics.si-energy",
+	})
+	energyTodayJoulesMetric = defineMetric(metricDef{
+		Name:      "energy_today_joules",
+		Type:      "gauge",
+		Unit:      "joules",
+		Help:      "Energy exported or imported by source since local midnight, in joules; also needs -metrics.energy-today",
+		Labels:    []string{"source", "direction"},
+		Collector: "meters",
+		Requires:  "-metrics.si-energy",
+	})
+	nominalFullPackEnergyJoulesMetric = defineMetric(metricDef{
+		Name:      "nominal_full_pack_energy_joules",
+		Type:      "gauge",
+		Unit:      "joules",
+		Help:      "Nominal energy of all batteries when full, in joules",
+		Collector: "system_status",
+		Requires:  "-metrics.si-energy",
+	})
+	nominalEnergyRemainingJoulesMetric = defineMetric(metricDef{
+		Name:      "nominal_energy_remaining_joules",
+		Type:      "gauge",
+		Unit:      "joules",
+		Help:      "Nominal energy remaining in all batteries, in joules",
+		Collector: "system_status",
+		Requires:  "-metrics.si-energy",
+	})
+)
+
+func populateEnergyJoules(source string, rec Record, reg *prometheus.Registry) error {
+	exported, err := energyExportedJoulesMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	exported.WithLabelValues(source).Set(rec.EnergyExported * joulesPerWattHour)
+
+	imported, err := energyImportedJoulesMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	imported.WithLabelValues(source).Set(rec.EnergyImported * joulesPerWattHour)
+
+	return nil
+}
+
+func populateBatteryEnergyJoules(fullPack float64, remaining float64, reg *prometheus.Registry) error {
+	fullPackJoules, err := nominalFullPackEnergyJoulesMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	fullPackJoules.Set(fullPack * joulesPerWattHour)
+
+	remainingJoules, err := nominalEnergyRemainingJoulesMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	remainingJoules.Set(remaining * joulesPerWattHour)
+
+	return nil
+}
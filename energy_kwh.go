@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The gateway reports energy in Wh. Dashboards written for kWh then show
+// values 1000 times too large, so the counters can also be exported in kWh
+// under names that make the unit explicit.
+var energyKWh = flag.Bool("metrics.energy-kwh", false, "Also export the lifetime energy counters in kWh, as energy_exported_kwh and energy_imported_kwh.")
+
+var (
+	energyExportedKWhMetric = defineMetric(metricDef{
+		Name:      "energy_exported_kwh",
+		Type:      "gauge",
+		Unit:      "kilowatt_hours",
+		Help:      "Lifetime energy exported by source, in kWh (the gateway reports Wh; see energy_exported)",
+		Labels:    []string{"source"},
+		Collector: "meters",
+		Requires:  "-metrics.energy-kwh",
+	})
+	energyImportedKWhMetric = defineMetric(metricDef{
+		Name:      "energy_imported_kwh",
+		Type:      "gauge",
+		Unit:      "kilowatt_hours",
+		Help:      "Lifetime energy imported by source, in kWh (the gateway reports Wh; see energy_imported)",
+		Labels:    []string{"source"},
+		Collector: "meters",
+		Requires:  "-metrics.energy-kwh",
+	})
+)
+
+func populateEnergyKWh(source string, rec Record, reg *prometheus.Registry) error {
+	exported, err := energyExportedKWhMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	exported.WithLabelValues(source).Set(rec.EnergyExported / 1000)
+
+	imported, err := energyImportedKWhMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	imported.WithLabelValues(source).Set(rec.EnergyImported / 1000)
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// optionalFloat is a number that only some firmware reports. It may be
+// missing, null, or sent as a string; anything that isn't a number leaves it
+// unset rather than failing the whole response.
+type optionalFloat struct {
+	value float64
+	ok    bool
+}
+
+func (f *optionalFloat) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseFloat(strings.Trim(string(data), `"`), 64)
+	if err != nil {
+		*f = optionalFloat{}
+		return nil
+	}
+	*f = optionalFloat{value: v, ok: true}
+	return nil
+}
+
+var (
+	reactiveEnergyExportedMetric = defineMetric(metricDef{
+		Name:      "reactive_energy_exported",
+		Type:      "gauge",
+		Unit:      "volt_ampere_reactive_hours",
+		Help:      "Lifetime reactive energy exported by source, in varh, on firmware that reports it",
+		Labels:    []string{"source"},
+		Collector: "meters",
+	})
+	reactiveEnergyImportedMetric = defineMetric(metricDef{
+		Name:      "reactive_energy_imported",
+		Type:      "gauge",
+		Unit:      "volt_ampere_reactive_hours",
+		Help:      "Lifetime reactive energy imported by source, in varh, on firmware that reports it",
+		Labels:    []string{"source"},
+		Collector: "meters",
+	})
+	apparentEnergyExportedMetric = defineMetric(metricDef{
+		Name:      "apparent_energy_exported",
+		Type:      "gauge",
+		Unit:      "volt_ampere_hours",
+		Help:      "Lifetime apparent energy exported by source, in VAh, on firmware that reports it",
+		Labels:    []string{"source"},
+		Collector: "meters",
+	})
+	apparentEnergyImportedMetric = defineMetric(metricDef{
+		Name:      "apparent_energy_imported",
+		Type:      "gauge",
+		Unit:      "volt_ampere_hours",
+		Help:      "Lifetime apparent energy imported by source, in VAh, on firmware that reports it",
+		Labels:    []string{"source"},
+		Collector: "meters",
+	})
+)
+
+// populateAccumulators exports the reactive and apparent energy accumulators
+// of rec that the gateway reported. Like energy_exported they are gauges
+// holding the gateway's own lifetime totals, which reset when it does.
+// Firmware without them gets no series, or zero with -metrics.always-emit.
+func populateAccumulators(source string, rec Record, reg *prometheus.Registry) error {
+	accumulators := []struct {
+		def   *metricDef
+		value optionalFloat
+	}{
+		{reactiveEnergyExportedMetric, rec.ReactiveEnergyExported},
+		{reactiveEnergyImportedMetric, rec.ReactiveEnergyImported},
+		{apparentEnergyExportedMetric, rec.ApparentEnergyExported},
+		{apparentEnergyImportedMetric, rec.ApparentEnergyImported},
+	}
+
+	for _, a := range accumulators {
+		if !a.value.ok && !*alwaysEmit {
+			continue
+		}
+		gauge, err := a.def.gaugeVec(reg)
+		if err != nil {
+			return err
+		}
+		gauge.WithLabelValues(source).Set(a.value.value)
+	}
+
+	return nil
+}
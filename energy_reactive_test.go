@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestReactiveAccumulators(t *testing.T) {
+	partial, err := os.ReadFile(filepath.Join("testdata", "meters", "accumulators-partial.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		firmware string
+		meters   string
+		// want is each accumulator's site value; missing ones must be
+		// absent.
+		want map[*metricDef]float64
+	}{
+		{"present", "23.44.0", "", map[*metricDef]float64{
+			reactiveEnergyExportedMetric: 120345.5,
+			reactiveEnergyImportedMetric: 98765.25,
+			apparentEnergyExportedMetric: 4601234.5,
+			apparentEnergyImportedMetric: 3501234.75,
+		}},
+		{"absent", "20.49.0", "", map[*metricDef]float64{}},
+		{"partial", "23.44.0", string(partial), map[*metricDef]float64{
+			reactiveEnergyExportedMetric: 120345.5,
+			apparentEnergyImportedMetric: 3501234.75,
+		}},
+	}
+
+	for _, tt := range tests {
+		gw := newMockGateway(t, tt.firmware)
+		if tt.meters != "" {
+			gw.set("/api/meters/aggregates", mockResponse{contentType: "application/json", body: tt.meters})
+		}
+
+		reg := prometheus.NewRegistry()
+		if err := collectorNamed(t, "meters").collect(context.Background(), gw.target(), reg); err != nil {
+			t.Fatalf("%s: collect failed: %v", tt.name, err)
+		}
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		types := map[string]dto.MetricType{}
+		for _, mf := range families {
+			types[mf.GetName()] = mf.GetType()
+		}
+
+		for _, d := range []*metricDef{reactiveEnergyExportedMetric, reactiveEnergyImportedMetric, apparentEnergyExportedMetric, apparentEnergyImportedMetric} {
+			want, present := tt.want[d]
+			got, ok := gathered(t, reg, d.Name)["source=site"]
+			switch {
+			case ok && !present:
+				t.Errorf("%s: %s = %v, want absent", tt.name, d.Name, got)
+			case present && (!ok || got != want):
+				t.Errorf("%s: %s = %v (present %v), want %v", tt.name, d.Name, got, ok, want)
+			}
+			if typ, ok := types[d.Name]; ok && typ != dto.MetricType_GAUGE {
+				t.Errorf("%s: %s is a %v, want a gauge like %s", tt.name, d.Name, typ, energyExportedMetric.Name)
+			}
+		}
+	}
+}
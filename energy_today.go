@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	energyToday = flag.Bool("metrics.energy-today", false, "Export energy exported and imported per source since local midnight. Relies on per-target state; use background scraping for accurate values.")
+	tz          = flag.String("tz", "", "Time zone used to determine local midnight, e.g. Australia/Melbourne. Defaults to the timezone reported by the gateway's /api/site_info.")
+)
+
+var (
+	energyTodayWhMetric = defineMetric(metricDef{
+		Name:      "energy_today_wh",
+		Type:      "gauge",
+		Unit:      "watt_hours",
+		Help:      "Energy exported or imported by source since local midnight, in Wh",
+		Labels:    []string{"source", "direction"},
+		Collector: "meters",
+		Requires:  "-metrics.energy-today",
+	})
+	energyTodayKWhMetric = defineMetric(metricDef{
+		Name:      "energy_today_kwh",
+		Type:      "gauge",
+		Unit:      "kilowatt_hours",
+		Help:      "Energy exported or imported by source since local midnight, in kWh",
+		Labels:    []string{"source", "direction"},
+		Collector: "meters",
+		Requires:  "-metrics.energy-today",
+	})
+	energyTodaySinceMetric = defineMetric(metricDef{
+		Name:      "energy_today_since_timestamp_seconds",
+		Type:      "gauge",
+		Unit:      "seconds",
+		Help:      "Time from which energy_today is counted: local midnight, or when the exporter started if that was later in the day",
+		Collector: "meters",
+		Requires:  "-metrics.energy-today",
+	})
+)
+
+// tzLocation is the parsed form of -tz, or nil to ask each gateway.
+var tzLocation *time.Location
+
+// dailyEnergy remembers each lifetime energy counter as it stood at the end
+// of the previous local day, so the energy moved "today" is the difference
+// between the current counter and that baseline.
+type dailyEnergy struct {
+	day      string
+	since    time.Time
+	baseline map[string]float64
+	last     map[string]float64
+}
+
+// observe records value for the counter identified by key at now, in local
+// time, and returns how much the counter has grown since the day started.
+func (d *dailyEnergy) observe(now time.Time, key string, value float64) float64 {
+	// Working with the calendar date rather than a fixed 24h period means
+	// days that are 23 or 25 hours long across DST transitions still reset
+	// exactly at local midnight.
+	if day := now.Format("2006-01-02"); d.day != day {
+		// Yesterday's final readings become today's baselines, so energy
+		// moved between the last sample before midnight and the first one
+		// after it is attributed to the new day rather than lost. On the
+		// first day there are none, so counting starts from now.
+		if d.last == nil {
+			d.since = now
+		} else {
+			year, month, date := now.Date()
+			d.since = time.Date(year, month, date, 0, 0, 0, 0, now.Location())
+		}
+		d.day = day
+		d.baseline = d.last
+		if d.baseline == nil {
+			d.baseline = map[string]float64{}
+		}
+		d.last = map[string]float64{}
+	}
+	d.last[key] = value
+
+	base, ok := d.baseline[key]
+	if !ok || value < base {
+		// First time we've seen this counter, or it went backwards because
+		// the gateway was reset: start counting again from here.
+		d.baseline[key] = value
+		base = value
+	}
+	return value - base
+}
+
+// timezone returns the location used to work out the local day for host.
+// Callers must not hold the target's state lock: the first call queries the
+// gateway, and holding the lock across that would stall every other scrape
+// of the target behind it.
+func timezone(ctx context.Context, host string) *time.Location {
+	if tzLocation != nil {
+		return tzLocation
+	}
+
+	state := stateFor(host)
+	state.mu.Lock()
+	loc := state.location
+	state.mu.Unlock()
+	if loc != nil {
+		return loc
+	}
+
+	info, err := cachedSiteInfo(ctx, host)
+	if err != nil {
+		slog.WarnContext(ctx, "Determining gateway timezone failed, falling back to local time", "target", host, "error", err)
+		return time.Local
+	}
+	loc, err = time.LoadLocation(info.Timezone)
+	if err != nil {
+		slog.WarnContext(ctx, "Loading gateway timezone failed, falling back to local time", "target", host, "timezone", info.Timezone, "error", err)
+		return time.Local
+	}
+
+	state.mu.Lock()
+	state.location = loc
+	state.mu.Unlock()
+	return loc
+}
+
+// populateEnergyToday exports the energy moved per source since local
+// midnight, derived from the gateway's lifetime energy counters.
+func populateEnergyToday(ctx context.Context, host string, status *PowerwallStatus, reg *prometheus.Registry) error {
+	energyWh, err := energyTodayWhMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	energyKWh, err := energyTodayKWhMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	since, err := energyTodaySinceMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	var energyJoules *prometheus.GaugeVec
+	if *siEnergy {
+		if energyJoules, err = energyTodayJoulesMetric.gaugeVec(reg); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().In(timezone(ctx, host))
+
+	state := stateFor(host)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.energyToday == nil {
+		state.energyToday = &dailyEnergy{}
+	}
+
+	records := status.Records()
+	for _, source := range Sources {
+		rec := records[source]
+		exported := state.energyToday.observe(now, source+"/exported", rec.EnergyExported)
+		imported := state.energyToday.observe(now, source+"/imported", rec.EnergyImported)
+		energyWh.WithLabelValues(source, "exported").Set(exported)
+		energyWh.WithLabelValues(source, "imported").Set(imported)
+		energyKWh.WithLabelValues(source, "exported").Set(exported / 1000)
+		energyKWh.WithLabelValues(source, "imported").Set(imported / 1000)
+		if energyJoules != nil {
+			energyJoules.WithLabelValues(source, "exported").Set(exported * joulesPerWattHour)
+			energyJoules.WithLabelValues(source, "imported").Set(imported * joulesPerWattHour)
+		}
+	}
+	since.Set(float64(state.energyToday.since.UnixNano()) / 1e9)
+
+	return nil
+}
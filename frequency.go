@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Grid frequency wanders a few hundredths of a hertz either side of nominal
+// all the time. Rounding hides that jitter, and the out-of-band indicator
+// turns the rare large excursions, which do mean something happened on the
+// grid, into a signal that can be alerted on directly.
+var (
+	frequencyRound     = flag.Int("frequency.round", -1, "Round frequency to this many decimal places before exporting it. Negative disables rounding.")
+	frequencyOutOfBand = flag.Bool("frequency.out-of-band", false, "Export frequency_out_of_band, 1 for sources whose frequency is more than -frequency.band from nominal.")
+	frequencyBand      = flag.Float64("frequency.band", 0.5, "How far, in Hz, frequency may stray from nominal before -frequency.out-of-band flags it.")
+	frequencyNominal   = flag.Float64("frequency.nominal", 0, "Nominal grid frequency in Hz for -frequency.out-of-band. 0 uses whichever of 50 and 60 Hz is closer to each reading.")
+)
+
+var frequencyOutOfBandMetric = defineMetric(metricDef{
+	Name:      "frequency_out_of_band",
+	Type:      "gauge",
+	Help:      "Whether the source's frequency is more than -frequency.band from nominal; absent while the source reports no frequency",
+	Labels:    []string{"source"},
+	Collector: "meters",
+	Requires:  "-frequency.out-of-band",
+})
+
+// exportedFrequency returns f as it should be exported, rounded according
+// to -frequency.round.
+func exportedFrequency(f float64) float64 {
+	if *frequencyRound >= 0 {
+		return roundTo(f, *frequencyRound)
+	}
+	return f
+}
+
+// nominalFrequency returns the nominal frequency to compare f against.
+func nominalFrequency(f float64) float64 {
+	if *frequencyNominal > 0 {
+		return *frequencyNominal
+	}
+	if f > 55 {
+		return 60
+	}
+	return 50
+}
+
+// populateFrequencyBand flags source if its frequency is out of band. The
+// check uses the raw reading, not the rounded one, so rounding can't push a
+// reading across the edge of the band. A source reporting 0 Hz has no
+// frequency measurement, e.g. a meter that isn't installed, and is left out.
+func populateFrequencyBand(source string, rec Record, reg *prometheus.Registry) error {
+	if rec.Frequency == 0 {
+		return nil
+	}
+
+	outOfBand, err := frequencyOutOfBandMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	deviation := math.Abs(rec.Frequency - nominalFrequency(rec.Frequency))
+	outOfBand.WithLabelValues(source).Set(boolToFloat(deviation > *frequencyBand))
+	return nil
+}
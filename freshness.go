@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var freshnessMaxAge = flag.Duration("freshness.max-age", 0, "Suppress a source's instantaneous metrics when its last_communication_time is older than this. 0 disables the check.")
+
+// A source missing from /api/meters/aggregates decodes as a zero Record, so
+// its metrics are exported as zero unless -freshness.max-age hides them.
+// -metrics.always-emit makes that continuity a guarantee: it refuses the
+// option that would break it, and exports zero wherever a series would
+// otherwise go missing.
+var alwaysEmit = flag.Bool("metrics.always-emit", false, "Always export every source's full set of metrics, as zero when the source is absent from the gateway's response, a firmware doesn't report a field, or its collector is skipped, so series never disappear. Cannot be combined with -freshness.max-age.")
+
+var sourceStaleMetric = defineMetric(metricDef{
+	Name:      "source_stale",
+	Type:      "gauge",
+	Help:      "Whether the source's data is older than -freshness.max-age, in which case its instantaneous metrics are suppressed",
+	Labels:    []string{"source"},
+	Collector: "meters",
+	Requires:  "-freshness.max-age",
+})
+
+// sourceStale reports whether rec was last updated longer ago than
+// -freshness.max-age, measured on the clock chosen by -staleness.clock.
+func sourceStale(rec Record) bool {
+	now := rec.reference
+	if now.IsZero() {
+		now = time.Now()
+	}
+	return now.Sub(rec.LastCommunicationTime) > *freshnessMaxAge
+}
+
+func populateSourceStale(source string, stale bool, reg *prometheus.Registry) error {
+	staleGauge, err := sourceStaleMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	staleGauge.WithLabelValues(source).Set(boolToFloat(stale))
+
+	return nil
+}
+
+// populateZeros exports the metrics c would have produced as zero, for
+// -metrics.always-emit when c is skipped. Metrics labelled by anything but
+// source have no values to guess and are left out, as are those needing an
+// option that is off.
+func populateZeros(c *collector, reg *prometheus.Registry) error {
+	for _, d := range catalog {
+		if d.Collector != c.name || d.Path != "/probe" || !requirementMet(d.Requires) {
+			continue
+		}
+
+		switch {
+		case len(d.Labels) == 0 && d.Type == "counter":
+			if _, err := d.counter(reg); err != nil {
+				return err
+			}
+		case len(d.Labels) == 0:
+			if _, err := d.gauge(reg); err != nil {
+				return err
+			}
+		case len(d.Labels) == 1 && d.Labels[0] == "source" && d.Type == "counter":
+			vec, err := d.counterVec(reg)
+			if err != nil {
+				return err
+			}
+			for _, source := range Sources {
+				vec.WithLabelValues(source)
+			}
+		case len(d.Labels) == 1 && d.Labels[0] == "source":
+			vec, err := d.gaugeVec(reg)
+			if err != nil {
+				return err
+			}
+			for _, source := range Sources {
+				vec.WithLabelValues(source)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestAlwaysEmitAccumulators(t *testing.T) {
+	for _, emit := range []bool{false, true} {
+		setFlag(t, alwaysEmit, emit)
+
+		reg := prometheus.NewRegistry()
+		if err := populateAccumulators("site", Record{}, reg); err != nil {
+			t.Fatal(err)
+		}
+		got, ok := gathered(t, reg, reactiveEnergyExportedMetric.Name)["source=site"]
+		switch {
+		case emit && (!ok || got != 0):
+			t.Errorf("with -metrics.always-emit, %s = %v (present %v), want 0", reactiveEnergyExportedMetric.Name, got, ok)
+		case !emit && ok:
+			t.Errorf("without -metrics.always-emit, %s exported for a firmware without it", reactiveEnergyExportedMetric.Name)
+		}
+	}
+}
+
+func TestAlwaysEmitSkippedCollector(t *testing.T) {
+	gw := newMockGateway(t, "auth-required")
+	query := url.Values{"target": {gw.target()}, "collect": {"meters,status"}}
+
+	for _, emit := range []bool{false, true} {
+		setFlag(t, alwaysEmit, emit)
+
+		g := parsed(t, probe(t, query))
+		got, ok := gathered(t, g, instantPowerMetric.Name)["source=solar"]
+		switch {
+		case emit && (!ok || got != 0):
+			t.Errorf("with -metrics.always-emit, %s{source=solar} = %v (present %v), want 0", instantPowerMetric.Name, got, ok)
+		case !emit && ok:
+			t.Errorf("without -metrics.always-emit, %s exported for a skipped collector", instantPowerMetric.Name)
+		}
+	}
+}
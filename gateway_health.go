@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GatewayHealth is the host health some firmware adds to /api/status. None
+// of the firmware we've seen reports it, so the fields are only picked up
+// under these names and anything else is ignored.
+type GatewayHealth struct {
+	LoadAverage     optionalFloat `json:"load_average"`
+	DiskUsedPercent optionalFloat `json:"disk_used_percent"`
+	MemoryFreeBytes optionalFloat `json:"memory_free_bytes"`
+}
+
+var (
+	gatewayLoadMetric = defineMetric(metricDef{
+		Name:      "gateway_load",
+		Type:      "gauge",
+		Help:      "Load average of the gateway, on firmware that reports it",
+		Collector: "gateway_health",
+	})
+	gatewayDiskUsedMetric = defineMetric(metricDef{
+		Name:      "gateway_disk_used_percent",
+		Type:      "gauge",
+		Unit:      "percent",
+		Help:      "Percentage of the gateway's storage in use, on firmware that reports it",
+		Collector: "gateway_health",
+	})
+	gatewayMemoryFreeMetric = defineMetric(metricDef{
+		Name:      "gateway_memory_free_bytes",
+		Type:      "gauge",
+		Unit:      "bytes",
+		Help:      "Free memory on the gateway, on firmware that reports it",
+		Collector: "gateway_health",
+	})
+)
+
+func queryGatewayHealth(ctx context.Context, host string) (*GatewayHealth, error) {
+	health := &GatewayHealth{}
+	if err := queryAPI(ctx, host, "/api/status", health); err != nil {
+		return nil, err
+	}
+	return health, nil
+}
+
+// collectGatewayHealth exports whatever host health the gateway reports. A
+// gateway whose storage fills up eventually fails, and nothing else the API
+// offers warns of it. Firmware that reports none of it gets no series.
+func collectGatewayHealth(ctx context.Context, host string, reg *prometheus.Registry) error {
+	health, err := queryGatewayHealth(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	fields := []struct {
+		def   *metricDef
+		value optionalFloat
+	}{
+		{gatewayLoadMetric, health.LoadAverage},
+		{gatewayDiskUsedMetric, health.DiskUsedPercent},
+		{gatewayMemoryFreeMetric, health.MemoryFreeBytes},
+	}
+
+	for _, f := range fields {
+		if !f.value.ok {
+			continue
+		}
+		gauge, err := f.def.gauge(reg)
+		if err != nil {
+			return err
+		}
+		gauge.Set(f.value.value)
+	}
+
+	return nil
+}
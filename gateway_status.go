@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	gatewayInfoMetric = defineMetric(metricDef{
+		Name:      "gateway_info",
+		Type:      "gauge",
+		Help:      "Gateway firmware version and identity, always 1",
+		Labels:    []string{"version", "din", "device_type"},
+		Collector: "status",
+	})
+	gatewayStartTimeMetric = defineMetric(metricDef{
+		Name:      "gateway_start_time_seconds",
+		Type:      "gauge",
+		Unit:      "seconds",
+		Help:      "Time the gateway last started, as a Unix timestamp",
+		Collector: "status",
+	})
+	gatewayUptimeMetric = defineMetric(metricDef{
+		Name:      "gateway_uptime_seconds",
+		Type:      "gauge",
+		Unit:      "seconds",
+		Help:      "Time since the gateway last started, as reported by the gateway",
+		Collector: "status",
+	})
+)
+
+// startTimeFormats are the start_time layouts seen from different firmware,
+// most common first. Fractional seconds are accepted by every layout, since
+// time.Parse allows them after the seconds field even when the layout
+// doesn't mention them.
+var startTimeFormats = []struct {
+	name   string
+	layout string
+}{
+	{"space, numeric zone", "2006-01-02 15:04:05 -0700"},
+	{"space, colon zone", "2006-01-02 15:04:05 -07:00"},
+	{"RFC 3339", time.RFC3339},
+	{"space, no zone", "2006-01-02 15:04:05"},
+	{"ISO 8601, no zone", "2006-01-02T15:04:05"},
+}
+
+// parseStartTime parses the gateway's start_time. Times without a zone are
+// taken to be in loc.
+func parseStartTime(value string, loc *time.Location) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, f := range startTimeFormats {
+		t, err := time.ParseInLocation(f.layout, value, loc)
+		if err == nil {
+			slog.Debug("Parsed gateway start time", "value", value, "format", f.name)
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("unrecognised start_time %q", value)
+}
+
+// parseUptime parses the gateway's up_time_seconds, which despite its name
+// is a Go duration string such as "123h4m5.678s" on most firmware and a
+// plain number of seconds on some.
+func parseUptime(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if secs, err := strconv.ParseFloat(value, 64); err == nil {
+		slog.Debug("Parsed gateway uptime", "value", value, "format", "seconds")
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		slog.Debug("Parsed gateway uptime", "value", value, "format", "duration")
+		return d, nil
+	}
+	return 0, errors.Errorf("unrecognised up_time_seconds %q", value)
+}
+
+func collectStatus(ctx context.Context, host string, reg *prometheus.Registry) error {
+	status, err := queryGatewayStatus(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	info, err := gatewayInfoMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	info.WithLabelValues(status.Version, status.DIN, status.DeviceType).Set(1)
+
+	// A firmware with a format we don't know shouldn't cost users the rest
+	// of the collector, so unparseable times are logged and skipped.
+	if status.StartTime != "" {
+		if start, err := parseStartTime(status.StartTime, timezone(ctx, host)); err != nil {
+			slog.WarnContext(ctx, "Parsing gateway start time failed", "target", host, "error", err)
+		} else {
+			startTime, err := gatewayStartTimeMetric.gauge(reg)
+			if err != nil {
+				return err
+			}
+			startTime.Set(float64(start.UnixNano()) / 1e9)
+		}
+	}
+
+	if status.UpTime != "" {
+		if up, err := parseUptime(status.UpTime); err != nil {
+			slog.WarnContext(ctx, "Parsing gateway uptime failed", "target", host, "error", err)
+		} else {
+			uptime, err := gatewayUptimeMetric.gauge(reg)
+			if err != nil {
+				return err
+			}
+			uptime.Set(up.Seconds())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseStartTime(t *testing.T) {
+	want := time.Date(2024, 2, 29, 20, 45, 12, 0, time.UTC)
+	perth, err := time.LoadLocation("Australia/Perth")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		value string
+		loc   *time.Location
+		want  time.Time
+	}{
+		{"2024-03-01 07:45:12 +1100", time.UTC, want},
+		{"2024-03-01 07:45:12 +11:00", time.UTC, want},
+		{"2024-02-29T20:45:12Z", time.UTC, want},
+		{"2024-03-01T07:45:12+11:00", time.UTC, want},
+		{"2024-03-01T07:45:12.250+11:00", time.UTC, want.Add(250 * time.Millisecond)},
+		{"2024-03-01 07:45:12.5 +1100", time.UTC, want.Add(500 * time.Millisecond)},
+		{"2024-02-29 20:45:12", time.UTC, want},
+		{"2024-03-01 04:45:12", perth, want},
+		{"2024-02-29T20:45:12", time.UTC, want},
+		{" 2024-02-29T20:45:12Z\n", time.UTC, want},
+	}
+	for _, tt := range tests {
+		got, err := parseStartTime(tt.value, tt.loc)
+		if err != nil {
+			t.Errorf("parseStartTime(%q) failed: %v", tt.value, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseStartTime(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"", "01/03/2024 07:45", "yesterday"} {
+		if got, err := parseStartTime(value, time.UTC); err == nil {
+			t.Errorf("parseStartTime(%q) = %v, want an error", value, got)
+		}
+	}
+}
+
+func TestParseUptime(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"150h30m1.5s", 150*time.Hour + 30*time.Minute + 1500*time.Millisecond},
+		{"541801.5", 541801500 * time.Millisecond},
+		{"3600", time.Hour},
+		{" 1m \n", time.Minute},
+	}
+	for _, tt := range tests {
+		got, err := parseUptime(tt.value)
+		if err != nil {
+			t.Errorf("parseUptime(%q) failed: %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseUptime(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"", "a week", "1 day"} {
+		if got, err := parseUptime(value); err == nil {
+			t.Errorf("parseUptime(%q) = %v, want an error", value, got)
+		}
+	}
+}
+
+// TestStartTimeFormats collects /api/status responses carrying each
+// start_time format seen from gateways, from testdata/start_time.
+func TestStartTimeFormats(t *testing.T) {
+	setFlag(t, &tzLocation, time.UTC)
+	const start = 1709239512.0
+
+	tests := []struct {
+		file   string
+		start  float64
+		uptime float64
+	}{
+		{"space-numeric-zone.json", start, 541801.5},
+		{"space-colon-zone.json", start, 541801.5},
+		{"rfc3339.json", start, 541801.5},
+		{"rfc3339-fractional.json", start + 0.25, 541801.5},
+		{"space-no-zone.json", start, 541801.5},
+		{"iso8601-no-zone.json", start, 541801.5},
+		// An unknown format costs only the start time.
+		{"unrecognised.json", 0, 541801.5},
+	}
+
+	gw := newMockGateway(t, "")
+	for _, tt := range tests {
+		body, err := os.ReadFile(filepath.Join("testdata", "start_time", tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gw.set("/api/status", mockResponse{contentType: "application/json", body: string(body)})
+
+		reg := prometheus.NewRegistry()
+		if err := collectStatus(context.Background(), gw.target(), reg); err != nil {
+			t.Errorf("%s: collect failed: %v", tt.file, err)
+			continue
+		}
+
+		got, ok := gathered(t, reg, gatewayStartTimeMetric.Name)[""]
+		switch {
+		case tt.start == 0 && ok:
+			t.Errorf("%s: %s = %v, want absent", tt.file, gatewayStartTimeMetric.Name, got)
+		case tt.start != 0 && math.Abs(got-tt.start) > 1e-3:
+			t.Errorf("%s: %s = %v (present %v), want %v", tt.file, gatewayStartTimeMetric.Name, got, ok, tt.start)
+		}
+		if got := gathered(t, reg, gatewayUptimeMetric.Name)[""]; got != tt.uptime {
+			t.Errorf("%s: %s = %v, want %v", tt.file, gatewayUptimeMetric.Name, got, tt.uptime)
+		}
+	}
+}
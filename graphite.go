@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	graphiteAddress = flag.String("graphite.address", "", "Carbon plaintext endpoint (host:port) to push background scrape results to.")
+	graphitePrefix  = flag.String("graphite.prefix", "powerwall", "Prefix for Graphite metric paths.")
+)
+
+// graphite is the Carbon writer, or nil when -graphite.address is unset.
+var graphite *graphiteWriter
+
+var graphiteDropped = defineMetric(metricDef{
+	Name:     "graphite_dropped_metrics_total",
+	Type:     "counter",
+	Help:     "Number of metrics that could not be delivered to Graphite",
+	Path:     "/metrics",
+	Requires: "-graphite.address",
+}).newCounter()
+
+func init() {
+	prometheus.MustRegister(graphiteDropped)
+}
+
+var graphiteUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// graphiteWriter pushes metrics to Carbon over a single long-lived TCP
+// connection, dialling it again whenever a write fails.
+type graphiteWriter struct {
+	address string
+	prefix  string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newGraphiteWriter(address string, prefix string) *graphiteWriter {
+	return &graphiteWriter{
+		address: address,
+		prefix:  prefix,
+	}
+}
+
+// graphitePath builds a dotted path for a metric as
+// <prefix>.<target>.<source>.<field>[.<other label values>...].
+func graphitePath(prefix string, target string, name string, labels []*dto.LabelPair) string {
+	parts := []string{prefix, target}
+
+	var source string
+	var rest []string
+	for _, l := range labels {
+		if l.GetName() == "source" {
+			source = l.GetValue()
+			continue
+		}
+		rest = append(rest, l.GetValue())
+	}
+	if source != "" {
+		parts = append(parts, source)
+	}
+	parts = append(parts, strings.TrimPrefix(name, Prefix+"_"))
+	parts = append(parts, rest...)
+
+	for i, p := range parts {
+		parts[i] = graphiteUnsafe.ReplaceAllString(p, "_")
+	}
+	return strings.Join(parts, ".")
+}
+
+// write sends every sample in families to Carbon with the given timestamp.
+func (g *graphiteWriter) write(target string, families []*dto.MetricFamily, ts time.Time) {
+	var buf bytes.Buffer
+	count := 0
+
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			var value float64
+			switch {
+			case m.Gauge != nil:
+				value = m.GetGauge().GetValue()
+			case m.Counter != nil:
+				value = m.GetCounter().GetValue()
+			case m.Untyped != nil:
+				value = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+
+			fmt.Fprintf(&buf, "%s %s %d\n",
+				graphitePath(g.prefix, target, mf.GetName(), m.GetLabel()),
+				strconv.FormatFloat(value, 'f', -1, 64),
+				ts.Unix(),
+			)
+			count++
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.conn == nil {
+		conn, err := net.DialTimeout("tcp", g.address, 5*time.Second)
+		if err != nil {
+			graphiteDropped.Add(float64(count))
+			slog.Error("Connecting to Graphite failed", "address", g.address, "error", err)
+			return
+		}
+		g.conn = conn
+	}
+
+	g.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := g.conn.Write(buf.Bytes()); err != nil {
+		g.conn.Close()
+		g.conn = nil
+		graphiteDropped.Add(float64(count))
+		slog.Error("Writing to Graphite failed", "address", g.address, "error", err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// siteInfoTTL is how long a target's site info is reused. The grid code
+// only changes when an installer recommissions the site, so there's no
+// point asking on every scrape.
+const siteInfoTTL = time.Hour
+
+// GridCode is the grid compliance setting from /api/site_info.
+type GridCode struct {
+	GridCode           string  `json:"grid_code"`
+	GridVoltageSetting float64 `json:"grid_voltage_setting"`
+	GridFreqSetting    float64 `json:"grid_freq_setting"`
+	GridPhaseSetting   string  `json:"grid_phase_setting"`
+}
+
+var (
+	gridCodeInfoMetric = defineMetric(metricDef{
+		Name:      "grid_code_info",
+		Type:      "gauge",
+		Help:      "Grid code the gateway is configured for, which sets its voltage and frequency trip limits, always 1",
+		Labels:    []string{"grid_code", "phase"},
+		Collector: "grid_code",
+	})
+	gridNominalVoltageMetric = defineMetric(metricDef{
+		Name:      "grid_nominal_voltage_volts",
+		Type:      "gauge",
+		Unit:      "volts",
+		Help:      "Nominal grid voltage of the configured grid code",
+		Collector: "grid_code",
+	})
+	gridNominalFrequencyMetric = defineMetric(metricDef{
+		Name:      "grid_nominal_frequency_hertz",
+		Type:      "gauge",
+		Unit:      "hertz",
+		Help:      "Nominal grid frequency of the configured grid code",
+		Collector: "grid_code",
+	})
+)
+
+// cachedSiteInfo returns host's site info, querying the gateway at most
+// once per siteInfoTTL.
+func cachedSiteInfo(ctx context.Context, host string) (*SiteInfo, error) {
+	state := stateFor(host)
+	state.mu.Lock()
+	info, fetched := state.siteInfo, state.siteInfoTime
+	state.mu.Unlock()
+
+	if info != nil && time.Since(fetched) < siteInfoTTL {
+		return info, nil
+	}
+
+	info, err := querySiteInfo(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	state.mu.Lock()
+	state.siteInfo, state.siteInfoTime = info, time.Now()
+	state.mu.Unlock()
+
+	return info, nil
+}
+
+func collectGridCode(ctx context.Context, host string, reg *prometheus.Registry) error {
+	info, err := cachedSiteInfo(ctx, host)
+	if err != nil {
+		return err
+	}
+	code := info.GridCode
+
+	gridCodeInfo, err := gridCodeInfoMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	gridCodeInfo.WithLabelValues(code.GridCode, code.GridPhaseSetting).Set(1)
+
+	// Zero means the firmware didn't say, not a 0V grid.
+	if code.GridVoltageSetting > 0 {
+		voltage, err := gridNominalVoltageMetric.gauge(reg)
+		if err != nil {
+			return err
+		}
+		voltage.Set(code.GridVoltageSetting)
+	}
+	if code.GridFreqSetting > 0 {
+		frequency, err := gridNominalFrequencyMetric.gauge(reg)
+		if err != nil {
+			return err
+		}
+		frequency.Set(code.GridFreqSetting)
+	}
+
+	return nil
+}
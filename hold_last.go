@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var holdLast = flag.Duration("metrics.hold-last", 0, "When a background scrape fails, keep serving the last successful values for up to this long, marked with up=0. 0 disables holding. Requires background scraping.")
+
+var upMetric = defineMetric(metricDef{
+	Name: "up",
+	Type: "gauge",
+	Help: "Whether the scrape of the gateway succeeded; with -metrics.hold-last, 0 means the other values are held from an earlier scrape",
+})
+
+var dataAgeMetric = defineMetric(metricDef{
+	Name:     "data_age_seconds",
+	Type:     "gauge",
+	Unit:     "seconds",
+	Help:     "Time since the values being served were collected from the gateway",
+	Requires: "-metrics.hold-last",
+})
+
+// heldResult builds the gatherer served for a background result when
+// -metrics.hold-last is on: the latest values if the last scrape succeeded,
+// otherwise the last good values if they're recent enough, alongside up and
+// data_age_seconds so held data can be told apart from fresh. It returns nil
+// if there is nothing to serve.
+func heldResult(result *scrapeResult, now time.Time) (prometheus.Gatherer, error) {
+	if result.lastGood == nil || now.Sub(result.lastGoodTime) > *holdLast {
+		return nil, nil
+	}
+
+	reg := prometheus.NewRegistry()
+	up, err := upMetric.gauge(reg)
+	if err != nil {
+		return nil, err
+	}
+	age, err := dataAgeMetric.gauge(reg)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.err == nil {
+		up.Set(1)
+	}
+	age.Set(now.Sub(result.lastGoodTime).Seconds())
+
+	return prometheus.Gatherers{result.lastGood, reg}, nil
+}
+
+// upGatherer returns tesla_powerwall_up set to value, for probes answered
+// without held data.
+func upGatherer(value float64) prometheus.Gatherer {
+	up := upMetric.newGauge()
+	up.Set(value)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(up)
+	return reg
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// useScraper scrapes targets in the background for the rest of the test,
+// and waits for the first scrape of each.
+func useScraper(t *testing.T, targets ...string) {
+	t.Helper()
+
+	s := newBackgroundScraper(time.Hour)
+	old := scraper
+	scraper = s
+	t.Cleanup(func() {
+		s.setTargets(nil)
+		scraper = old
+	})
+
+	s.setTargets(targets)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s.firstResults(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("timed out waiting for the first background scrapes")
+	}
+}
+
+func TestProbeUp(t *testing.T) {
+	for _, background := range []bool{false, true} {
+		for _, status := range []string{"200", "5xx"} {
+			setFlag(t, probeFailStatus, status)
+
+			gw := newMockGateway(t, "23.44.0")
+			failing := newMockGateway(t, "")
+			if background {
+				useScraper(t, gw.target(), failing.target())
+			}
+
+			rec := probe(t, url.Values{"target": {gw.target()}})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("background %v, fail-status %s: probe answered %d: %s", background, status, rec.Code, rec.Body.String())
+			}
+			if got, ok := gathered(t, parsed(t, rec), upMetric.Name)[""]; !ok || got != 1 {
+				t.Errorf("background %v, fail-status %s: %s = %v (present %v), want 1", background, status, upMetric.Name, got, ok)
+			}
+
+			rec = probe(t, url.Values{"target": {failing.target()}})
+			switch status {
+			case "200":
+				if rec.Code != http.StatusOK {
+					t.Fatalf("background %v, fail-status %s: failed probe answered %d, want 200", background, status, rec.Code)
+				}
+				if got, ok := gathered(t, parsed(t, rec), upMetric.Name)[""]; !ok || got != 0 {
+					t.Errorf("background %v, fail-status %s: %s = %v (present %v), want 0", background, status, upMetric.Name, got, ok)
+				}
+			case "5xx":
+				if rec.Code != http.StatusInternalServerError {
+					t.Errorf("background %v, fail-status %s: failed probe answered %d, want 500", background, status, rec.Code)
+				}
+			}
+		}
+	}
+}
+
+func TestProbeUpMultiTarget(t *testing.T) {
+	gw := newMockGateway(t, "20.49.0")
+	failing := newMockGateway(t, "")
+
+	rec := probe(t, url.Values{"target": {gw.target(), failing.target()}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("probe answered %d: %s", rec.Code, rec.Body.String())
+	}
+	up := gathered(t, parsed(t, rec), upMetric.Name)
+	for target, want := range map[string]float64{gw.target(): 1, failing.target(): 0} {
+		if got, ok := up[targetLabel+"="+target]; !ok || got != want {
+			t.Errorf("%s{%s=%q} = %v (present %v), want %v", upMetric.Name, targetLabel, target, got, ok, want)
+		}
+	}
+}
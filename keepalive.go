@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var keepaliveInterval = flag.Duration("auth.keepalive-interval", 0, "Query a cheap endpoint on any gateway that hasn't been scraped for this long, so its session doesn't expire between infrequent scrapes. 0 disables keep-alives.")
+
+var keepaliveSuccess = defineMetric(metricDef{
+	Name:     "keepalive_success",
+	Type:     "gauge",
+	Help:     "Whether the last keep-alive request to the target succeeded",
+	Labels:   []string{"target"},
+	Path:     "/metrics",
+	Requires: "-auth.keepalive-interval",
+}).newGaugeVec()
+
+func init() {
+	prometheus.MustRegister(keepaliveSuccess)
+}
+
+// keepaliveTimeout bounds each keep-alive request.
+const keepaliveTimeout = 10 * time.Second
+
+// runKeepalives pings every known gateway that has been idle for interval,
+// every interval. Gateways keep their session in the cookies the shared
+// client holds, and some firmware drops idle sessions, so the first scrape
+// after a long gap would otherwise fail.
+func runKeepalives(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var wg sync.WaitGroup
+		for _, target := range idleTargets(interval) {
+			wg.Add(1)
+			go func(target string) {
+				defer wg.Done()
+				keepalive(target)
+			}(target)
+		}
+		wg.Wait()
+	}
+}
+
+// idleTargets returns the gateways with per-target state that haven't been
+// scraped for at least idle. Only gateways whose last scrape succeeded have
+// a session worth keeping, and cloud targets hold none, so the rest are left
+// out.
+func idleTargets(idle time.Duration) []string {
+	statesMu.Lock()
+	candidates := make(map[string]*targetState, len(states))
+	for target, s := range states {
+		candidates[target] = s
+	}
+	statesMu.Unlock()
+
+	var targets []string
+	for target, s := range candidates {
+		if _, ok := cloudSite(target); ok {
+			continue
+		}
+		s.mu.Lock()
+		last, healthy := s.lastScrape, s.consecutiveSuccesses > 0
+		s.mu.Unlock()
+		if healthy && time.Since(last) >= idle {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// keepalive queries target's state of energy, the cheapest endpoint there
+// is, and records whether it worked.
+func keepalive(target string) {
+	ctx, cancel := context.WithTimeout(context.Background(), keepaliveTimeout)
+	defer cancel()
+
+	if _, err := queryStateOfEnergy(ctx, target); err != nil {
+		slog.Warn("Keep-alive failed", "target", target, "error", err)
+		keepaliveSuccess.WithLabelValues(target).Set(0)
+		return
+	}
+	slog.Debug("Keep-alive succeeded", "target", target)
+	keepaliveSuccess.WithLabelValues(target).Set(1)
+}
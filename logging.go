@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	logFormat = flag.String("log.format", "logfmt", "Log format, logfmt or json.")
+	logLevel  = flag.String("log.level", "info", "Only log messages at or above this level: debug, info, warn or error.")
+)
+
+// logLevelVar holds the active log level, so it can be changed at runtime.
+var logLevelVar = new(slog.LevelVar)
+
+// setupLogging installs the default logger according to -log.format and
+// -log.level.
+func setupLogging() error {
+	if err := logLevelVar.UnmarshalText([]byte(*logLevel)); err != nil {
+		return errors.Wrap(err, "parsing -log.level")
+	}
+
+	opts := &slog.HandlerOptions{
+		Level: logLevelVar,
+		// Errors wrapped by pkg/errors carry a stack trace that the text
+		// handler would print in full; the message chain is enough.
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Value.Kind() == slog.KindAny {
+				if err, ok := a.Value.Any().(error); ok {
+					return slog.String(a.Key, err.Error())
+				}
+			}
+			return a
+		},
+	}
+
+	var handler slog.Handler
+	switch *logFormat {
+	case "logfmt":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return errors.Errorf("unknown -log.format %q", *logFormat)
+	}
+
+	slog.SetDefault(slog.New(requestIDHandler{handler}))
+	return nil
+}
+
+// watchLogLevelSignals toggles between debug logging and -log.level each
+// time the process receives SIGUSR1, so a live problem can be traced without
+// a restart.
+func watchLogLevelSignals() {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+
+	var configured slog.Level
+	configured.UnmarshalText([]byte(*logLevel))
+
+	for range usr1 {
+		next := slog.LevelDebug
+		if logLevelVar.Level() == slog.LevelDebug {
+			next = configured
+		}
+		logLevelVar.Set(next)
+		// Logged at warn so the change is visible at every level but error.
+		slog.Warn("Log level changed", "level", next.String())
+	}
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
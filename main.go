@@ -1,13 +1,23 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/pkg/errors"
 
@@ -30,6 +40,18 @@ type Record struct {
 	InstantAverageVoltage float64   `json:"instant_average_voltage"`
 	InstantTotalCurrent   float64   `json:"instant_total_current"`
 	Timeout               int       `json:"timeout"`
+
+	// Reactive and apparent energy accumulators, only reported by some
+	// firmware.
+	ReactiveEnergyExported optionalFloat `json:"reactive_energy_exported"`
+	ReactiveEnergyImported optionalFloat `json:"reactive_energy_imported"`
+	ApparentEnergyExported optionalFloat `json:"apparent_energy_exported"`
+	ApparentEnergyImported optionalFloat `json:"apparent_energy_imported"`
+
+	// reference is "now" for judging how old the record is, on the clock
+	// chosen by -staleness.clock. It is zero for records not read from a
+	// gateway, which are judged by the exporter's clock.
+	reference time.Time
 }
 
 type PowerwallStatus struct {
@@ -39,6 +61,16 @@ type PowerwallStatus struct {
 	Solar   Record `json:"solar"`
 }
 
+// Records returns the per-source records keyed by their source name.
+func (s *PowerwallStatus) Records() map[string]Record {
+	return map[string]Record{
+		"site":    s.Site,
+		"battery": s.Battery,
+		"load":    s.Load,
+		"solar":   s.Solar,
+	}
+}
+
 type StateOfEnergy struct {
 	Percentage float64 `json:"percentage"`
 }
@@ -49,296 +81,947 @@ const (
 
 var Sources = []string{"site", "battery", "load", "solar"}
 
-func queryStateOfEnergy(host string) (*StateOfEnergy, error) {
+// normalizeTarget reduces a target given as a URL, e.g.
+// "https://192.168.1.50/", to the host[:port] the rest of the exporter
+// expects. The gateway only speaks HTTPS, so the scheme is dropped whatever
+// it was. Anything else is returned unchanged.
+func normalizeTarget(target string) string {
+	if !strings.Contains(target, "://") {
+		return target
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return target
+	}
+	slog.Debug("Stripped scheme from target", "target", target, "host", u.Host)
+	return u.Host
+}
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		},
+// Gateways reverse-proxied under a subpath, e.g.
+// https://home.example.com/powerwall/api/..., need that subpath put in front
+// of every API path.
+var apiBasePath = flag.String("api.base-path", "", "Path prefix the gateway API is served under, e.g. /powerwall for a gateway reverse-proxied at https://host/powerwall/api/.")
+
+// withBasePath returns the path to request for the API path p, with
+// -api.base-path in front of it. Joining cleans the result, so slashes
+// at either end of the base path don't double up.
+func withBasePath(p string) string {
+	if *apiBasePath == "" {
+		return p
 	}
+	return path.Join("/", *apiBasePath, p)
+}
 
-	// Basic HTTP GET request
-	resp, err := client.Get(fmt.Sprintf("https://%s/api/system_status/soe", host))
-	if err != nil {
-		return nil, errors.Wrap(err, "getting http response from Powerwall API")
+// apiEndpoint returns the API path requested as urlPath, without
+// -api.base-path, so per-endpoint metrics read the same either way.
+func apiEndpoint(urlPath string) string {
+	if *apiBasePath == "" {
+		return urlPath
 	}
-	defer resp.Body.Close()
+	if trimmed := strings.TrimPrefix(urlPath, path.Join("/", *apiBasePath)); strings.HasPrefix(trimmed, "/") {
+		return trimmed
+	}
+	return urlPath
+}
 
-	// Read body from response
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, errors.Wrap(err, "readinr http response from Powerwall API")
+// apiURL builds the URL for path on host, which may be a hostname, an IPv4
+// address or an IPv6 address (bracketed or bare), optionally with a port.
+// The simulated gateway is always served at the root.
+func apiURL(host string, path string) string {
+	if host == simulatorTarget && simulatorAddress != "" {
+		host = simulatorAddress
+	} else {
+		path = withBasePath(path)
+	}
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		host = net.JoinHostPort(h, port)
+	} else if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		// A bare IPv6 literal has colons but no port; it must be bracketed
+		// so the last group isn't taken for a port.
+		host = "[" + host + "]"
 	}
 
-	status := &StateOfEnergy{}
+	u := url.URL{
+		Scheme: "https",
+		Host:   host,
+		Path:   path,
+	}
+	return u.String()
+}
+
+var apiResponseBytes = defineMetric(metricDef{
+	Name:   "api_response_bytes",
+	Type:   "gauge",
+	Unit:   "bytes",
+	Help:   "Size of the most recent response body read from each gateway API endpoint",
+	Labels: []string{"endpoint"},
+	Path:   "/metrics",
+}).newGaugeVec()
+
+var unexpectedContentType = defineMetric(metricDef{
+	Name:   "unexpected_content_type_total",
+	Type:   "counter",
+	Help:   "Number of gateway API responses that were not JSON, usually a login or proxy error page",
+	Labels: []string{"endpoint"},
+	Path:   "/metrics",
+}).newCounterVec()
+
+var apiRequests = defineMetric(metricDef{
+	Name:   "api_requests_total",
+	Type:   "counter",
+	Help:   "Number of requests sent to gateway API endpoints, by HTTP status code or \"error\" if no response was received",
+	Labels: []string{"endpoint", "status"},
+	Path:   "/metrics",
+}).newCounterVec()
+
+func init() {
+	prometheus.MustRegister(apiResponseBytes)
+	prometheus.MustRegister(unexpectedContentType)
+	prometheus.MustRegister(apiRequests)
+}
 
-	if err = json.Unmarshal(body, status); err != nil {
-		return nil, errors.Wrap(err, "parsing JSON response from Powerwall API")
+// countAPIRequest records the outcome of a single request to a gateway,
+// which took elapsed. Requests made for a probe or background scrape carry
+// its request ID as an exemplar, linking the counter to the logs.
+func countAPIRequest(ctx context.Context, path string, resp *http.Response, err error, elapsed time.Duration) {
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	if err != nil {
+		slog.DebugContext(ctx, "Gateway request failed", "endpoint", path, "duration", elapsed, "error", err)
+	} else {
+		slog.DebugContext(ctx, "Gateway request", "endpoint", path, "status", status, "duration", elapsed)
 	}
 
-	fmt.Printf("%+v\n", status)
-	return status, nil
+	counter := apiRequests.WithLabelValues(path, status)
+	if id := requestIDFrom(ctx); id != "" {
+		counter.(prometheus.ExemplarAdder).AddWithExemplar(1, prometheus.Labels{"request_id": id})
+		return
+	}
+	counter.Inc()
 }
 
-func queryMeters(host string) (*PowerwallStatus, error) {
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		},
+// isJSONContentType reports whether a Content-Type header describes JSON.
+// A missing header is given the benefit of the doubt.
+func isJSONContentType(header string) bool {
+	if header == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// queryAPI performs a GET request against the given Powerwall API path and
+// decodes the JSON response body into v.
+func queryAPI(ctx context.Context, host string, path string, v interface{}) error {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL(host, path), nil)
+	if err != nil {
+		return errors.Wrap(err, "building request for Powerwall API")
 	}
+	// Some proxies in front of the gateway serve HTML unless asked for JSON.
+	req.Header.Set("Accept", "application/json")
 
-	// Basic HTTP GET request
-	resp, err := client.Get(fmt.Sprintf("https://%s/api/meters/aggregates", host))
+	// Basic HTTP GET request. The request is abandoned if ctx is cancelled,
+	// e.g. because Prometheus gave up on the probe.
+	resp, err := doRateLimited(ctx, host, req)
 	if err != nil {
-		return nil, errors.Wrap(err, "getting http response from Powerwall API")
+		if !errors.Is(err, errRateLimited) {
+			err = classify(errTransport, err)
+		}
+		return errors.Wrap(err, "getting http response from Powerwall API")
 	}
 	defer resp.Body.Close()
 
+	recordGatewayClock(host, resp.Header.Get("Date"), time.Now())
+
 	// Read body from response
 	body, err := ioutil.ReadAll(resp.Body)
+	apiResponseBytes.WithLabelValues(path).Set(float64(len(body)))
 	if err != nil {
-		return nil, errors.Wrap(err, "readinr http response from Powerwall API")
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = errors.Wrap(err, truncatedMessage)
+		}
+		return errors.Wrap(classify(errTransport, err), "reading http response from Powerwall API")
 	}
 
-	status := &PowerwallStatus{}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if apiErr := parseAPIError(body); apiErr != nil {
+			if apiErr.Code == 0 {
+				apiErr.Code = resp.StatusCode
+			}
+			return errors.Wrapf(apiErr, "querying %s", path)
+		}
+		return &HTTPStatusError{Code: resp.StatusCode, Path: path}
+	}
+
+	if ct := resp.Header.Get("Content-Type"); !isJSONContentType(ct) {
+		unexpectedContentType.WithLabelValues(path).Inc()
+		return errors.Wrapf(errUnexpectedContentType, "expected JSON from %s but got %q (HTTP %d); a login or proxy error page usually means something between the exporter and the gateway is intercepting requests", path, ct, resp.StatusCode)
+	}
+
+	if err = json.Unmarshal(body, v); err != nil {
+		if isTruncatedJSON(body, err) {
+			return errors.Wrap(classify(errTransport, errors.Wrap(err, truncatedMessage)), "reading http response from Powerwall API")
+		}
+		return errors.Wrap(classify(errParse, err), "parsing JSON response from Powerwall API")
+	}
+
+	if apiErr := parseAPIError(body); apiErr != nil {
+		return errors.Wrapf(apiErr, "querying %s", path)
+	}
+
+	return nil
+}
+
+// APIError is the error envelope some firmware returns with a 200 status
+// for endpoints it doesn't support, e.g.
+// {"code":404,"error":"Not Found","message":"..."}.
+type APIError struct {
+	Code    int    `json:"code"`
+	Err     string `json:"error"`
+	Message string `json:"message"`
+}
 
-	if err = json.Unmarshal(body, status); err != nil {
-		return nil, errors.Wrap(err, "parsing JSON response from Powerwall API")
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("gateway returned error %q", e.Err)
+	if e.Code != 0 {
+		msg = fmt.Sprintf("%s (code %d)", msg, e.Code)
+	}
+	if e.Message != "" {
+		msg = fmt.Sprintf("%s: %s", msg, e.Message)
 	}
+	return msg
+}
 
-	fmt.Printf("%+v\n", status)
+// parseAPIError returns the error described by body if it is an error
+// envelope rather than real data. Decoding an envelope into the expected
+// type succeeds with every field zeroed, so without this check the exporter
+// would happily report zeros.
+func parseAPIError(body []byte) *APIError {
+	apiErr := &APIError{}
+	if err := json.Unmarshal(body, apiErr); err != nil {
+		// Not an object, e.g. the array returned by /api/solars.
+		return nil
+	}
+	if apiErr.Err == "" {
+		return nil
+	}
+	return apiErr
+}
+
+func queryStateOfEnergy(ctx context.Context, host string) (*StateOfEnergy, error) {
+	status := &StateOfEnergy{}
+	if err := queryAPI(ctx, host, "/api/system_status/soe", status); err != nil {
+		return nil, err
+	}
 	return status, nil
+}
+
+func queryMeters(ctx context.Context, host string) (*PowerwallStatus, error) {
+	status := &PowerwallStatus{}
+	if err := queryAPI(ctx, host, "/api/meters/aggregates", status); err != nil {
+		return nil, err
+	}
 
+	reference := referenceTime(host)
+	for _, rec := range []*Record{&status.Site, &status.Battery, &status.Load, &status.Solar} {
+		rec.reference = reference
+	}
+	return status, nil
 }
 
+var (
+	instantPowerMetric = defineMetric(metricDef{
+		Name:      "instant_power",
+		Type:      "gauge",
+		Unit:      "watts",
+		Help:      "Instant power for source",
+		Labels:    []string{"source"},
+		Collector: "meters",
+	})
+	instantReactivePowerMetric = defineMetric(metricDef{
+		Name:      "instant_reactive_power",
+		Type:      "gauge",
+		Unit:      "volt_amperes_reactive",
+		Help:      "Instant reactive power for source",
+		Labels:    []string{"source"},
+		Collector: "meters",
+	})
+	instantApparentPowerMetric = defineMetric(metricDef{
+		Name:      "instant_apparent_power",
+		Type:      "gauge",
+		Unit:      "volt_amperes",
+		Help:      "Instant apparent power for source",
+		Labels:    []string{"source"},
+		Collector: "meters",
+	})
+	frequencyMetric = defineMetric(metricDef{
+		Name:      "frequency",
+		Type:      "gauge",
+		Unit:      "hertz",
+		Help:      "Frequency for source",
+		Labels:    []string{"source"},
+		Collector: "meters",
+	})
+	energyExportedMetric = defineMetric(metricDef{
+		Name:      "energy_exported",
+		Type:      "gauge",
+		Unit:      "watt_hours",
+		Help:      "Lifetime energy exported by source, in Wh as reported by the gateway",
+		Labels:    []string{"source"},
+		Collector: "meters",
+	})
+	energyImportedMetric = defineMetric(metricDef{
+		Name:      "energy_imported",
+		Type:      "gauge",
+		Unit:      "watt_hours",
+		Help:      "Lifetime energy imported by source, in Wh as reported by the gateway",
+		Labels:    []string{"source"},
+		Collector: "meters",
+	})
+	instantAverageVoltageMetric = defineMetric(metricDef{
+		Name:      "instant_average_voltage",
+		Type:      "gauge",
+		Unit:      "volts",
+		Help:      "Instant average voltage for source",
+		Labels:    []string{"source"},
+		Collector: "meters",
+	})
+	instantTotalCurrentMetric = defineMetric(metricDef{
+		Name:      "instant_total_current_amperes",
+		Type:      "gauge",
+		Unit:      "amperes",
+		Help:      "Instant total current for source as the gateway reports it; usually signed like instant_power (site negative while exporting, battery negative while charging), though some firmware reports it unsigned",
+		Labels:    []string{"source"},
+		Collector: "meters",
+		Legacy:    "instant_total_current",
+	})
+	instantTotalCurrentMagnitudeMetric = defineMetric(metricDef{
+		Name:      "instant_total_current_magnitude_amperes",
+		Type:      "gauge",
+		Unit:      "amperes",
+		Help:      "Magnitude of the instant total current for source, whatever its sign",
+		Labels:    []string{"source"},
+		Collector: "meters",
+		Requires:  "-metrics.derived",
+	})
+)
+
 func populateSource(source string, rec Record, reg *prometheus.Registry) error {
 
-	instantPower := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: fmt.Sprintf("%s_instant_power", Prefix),
-			Help: "Instant power for source",
-		},
-		[]string{"source"},
-	)
+	energyExported, err := energyExportedMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	energyExported.WithLabelValues(source).Set(rec.EnergyExported)
 
-	if err := reg.Register(instantPower); err != nil {
-		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
-			instantPower = are.ExistingCollector.(*prometheus.GaugeVec)
-		} else {
-			return errors.Wrap(err, "handling instant_power metric already registered")
+	energyImported, err := energyImportedMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	energyImported.WithLabelValues(source).Set(rec.EnergyImported)
+
+	if *energyKWh {
+		if err = populateEnergyKWh(source, rec, reg); err != nil {
+			return err
 		}
 	}
 
-	instantPower.WithLabelValues(source).Set(rec.InstantPower)
+	if *siEnergy {
+		if err = populateEnergyJoules(source, rec, reg); err != nil {
+			return err
+		}
+	}
 
-	instantReactivePower := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: fmt.Sprintf("%s_instant_reactive_power", Prefix),
-			Help: "Instant reactive power for source",
-		},
-		[]string{"source"},
-	)
+	if err = populateAccumulators(source, rec, reg); err != nil {
+		return err
+	}
 
-	if err := reg.Register(instantReactivePower); err != nil {
-		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
-			instantReactivePower = are.ExistingCollector.(*prometheus.GaugeVec)
-		} else {
-			return errors.Wrap(err, "handling instant_reactive_power metric already registered")
+	if *freshnessMaxAge > 0 {
+		stale := sourceStale(rec)
+		if err = populateSourceStale(source, stale, reg); err != nil {
+			return err
+		}
+		if stale {
+			// The lifetime energy counters are still correct, but frozen
+			// instantaneous readings shouldn't pass for current ones.
+			return nil
 		}
 	}
 
+	instantPower, err := instantPowerMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	instantPower.WithLabelValues(source).Set(rec.InstantPower)
+
+	instantReactivePower, err := instantReactivePowerMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
 	instantReactivePower.WithLabelValues(source).Set(rec.InstantReactivePower)
 
-	instantApparentPower := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: fmt.Sprintf("%s_instant_apparent_power", Prefix),
-			Help: "Instant reactive power for source",
-		},
-		[]string{"source"},
-	)
+	instantApparentPower, err := instantApparentPowerMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	instantApparentPower.WithLabelValues(source).Set(rec.InstantApparentPower)
 
-	if err := reg.Register(instantApparentPower); err != nil {
-		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
-			instantApparentPower = are.ExistingCollector.(*prometheus.GaugeVec)
-		} else {
-			return errors.Wrap(err, "handling instant_reactive_power metric already registered")
+	frequency, err := frequencyMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	frequency.WithLabelValues(source).Set(exportedFrequency(rec.Frequency))
+
+	if *frequencyOutOfBand {
+		if err = populateFrequencyBand(source, rec, reg); err != nil {
+			return err
 		}
 	}
 
-	instantApparentPower.WithLabelValues(source).Set(rec.InstantReactivePower)
+	instantAverageVoltage, err := instantAverageVoltageMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	instantAverageVoltage.WithLabelValues(source).Set(rec.InstantAverageVoltage)
 
-	frequency := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: fmt.Sprintf("%s_frequency", Prefix),
-			Help: "Frequency for source",
-		},
-		[]string{"source"},
-	)
+	instantTotalCurrent, err := instantTotalCurrentMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	instantTotalCurrent.WithLabelValues(source).Set(rec.InstantTotalCurrent)
 
-	if err := reg.Register(frequency); err != nil {
-		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
-			frequency = are.ExistingCollector.(*prometheus.GaugeVec)
-		} else {
-			return errors.Wrap(err, "handling instant_reactive_power metric already registered")
+	if *derivedMetrics {
+		magnitude, err := instantTotalCurrentMagnitudeMetric.gaugeVec(reg)
+		if err != nil {
+			return err
 		}
+		magnitude.WithLabelValues(source).Set(math.Abs(rec.InstantTotalCurrent))
 	}
 
-	frequency.WithLabelValues(source).Set(rec.Frequency)
+	if err = populateReadingValid(source, rec, reg); err != nil {
+		return err
+	}
 
-	energyExported := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: fmt.Sprintf("%s_energy_exported", Prefix),
-			Help: "Frequency for source",
-		},
-		[]string{"source"},
-	)
+	return nil
 
-	if err := reg.Register(energyExported); err != nil {
-		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
-			energyExported = are.ExistingCollector.(*prometheus.GaugeVec)
-		} else {
-			return errors.Wrap(err, "handling instant_reactive_power metric already registered")
+}
+
+var metricsCollectedMetric = defineMetric(metricDef{
+	Name:   "metrics_collected",
+	Type:   "gauge",
+	Help:   "Number of metrics produced by each collector in this scrape",
+	Labels: []string{"collector"},
+})
+
+var degradedMetric = defineMetric(metricDef{
+	Name: "degraded",
+	Type: "gauge",
+	Help: "Whether some collectors were skipped in this scrape because the gateway requires login for or doesn't serve their endpoints",
+})
+
+// collectTarget runs every enabled collector against target and returns a
+// gatherer holding the results. Each collector fills its own registry so the
+// number of metrics it produced can be reported alongside them; a drop in
+// that count after a firmware update is an early sign an endpoint changed.
+//
+// Some firmware serves a few endpoints without login but refuses the rest.
+// Collectors refused that way are skipped and the scrape is marked degraded,
+// so users who only want what's freely available still get it. With
+// -capabilities.recheck-interval, collectors whose endpoints are missing are
+// skipped the same way once detected. Any other error fails the whole
+// scrape.
+//
+// If fresh is set, every collector queries the gateway even if a cached
+// result from -scrape.slow-interval is available. If only is non-nil, it
+// replaces the collectors that would otherwise run, for a probe's collect
+// parameter.
+//
+// Every call counts towards the target's run of consecutive successes or
+// failures. The collectors run and the sources and labels returned follow
+// the target's entry in -config.file, if it has one.
+func collectTarget(ctx context.Context, target string, fresh bool, only []*collector) (g prometheus.Gatherer, err error) {
+	defer func() { recordScrapeOutcome(target, err) }()
+	defer func() {
+		if labels := targetLabels(target); err == nil && len(labels) > 0 {
+			g = labelGatherer{labels: labels, g: g}
 		}
-	}
+	}()
+	defer func() {
+		if sources := targetSources(target); err == nil && len(sources) > 0 {
+			g = sourceGatherer{sources: sources, g: g}
+		}
+	}()
 
-	energyExported.WithLabelValues(source).Set(rec.EnergyExported)
+	if site, ok := cloudSite(target); ok {
+		return collectCloudTarget(ctx, site)
+	}
 
-	energyImported := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: fmt.Sprintf("%s_energy_imported", Prefix),
-			Help: "Frequency for source",
-		},
-		[]string{"source"},
-	)
+	release, err := acquireScrapeSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
-	if err := reg.Register(energyImported); err != nil {
-		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
-			energyImported = are.ExistingCollector.(*prometheus.GaugeVec)
-		} else {
-			return errors.Wrap(err, "handling instant_reactive_power metric already registered")
-		}
+	summary := prometheus.NewRegistry()
+	collected, err := metricsCollectedMetric.gaugeVec(summary)
+	if err != nil {
+		return nil, err
 	}
 
-	energyImported.WithLabelValues(source).Set(rec.EnergyImported)
+	degraded, err := degradedMetric.gauge(summary)
+	if err != nil {
+		return nil, err
+	}
 
-	instantAverageVoltage := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: fmt.Sprintf("%s_instant_average_voltage", Prefix),
-			Help: "Frequency for source",
-		},
-		[]string{"source"},
-	)
+	gatherers := prometheus.Gatherers{summary}
 
-	if err := reg.Register(instantAverageVoltage); err != nil {
-		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
-			instantAverageVoltage = are.ExistingCollector.(*prometheus.GaugeVec)
-		} else {
-			return errors.Wrap(err, "handling instant_reactive_power metric already registered")
-		}
+	enabled := targetCollectors(target)
+	if only != nil {
+		enabled = only
 	}
+	caps := capabilitiesFor(ctx, target, only == nil)
+	var skipped int
+	for _, c := range enabled {
+		if cached := cachedResult(target, c); cached != nil && !fresh {
+			if err := countCollected(collected, c, cached); err != nil {
+				return nil, err
+			}
+			gatherers = append(gatherers, cached)
+			continue
+		}
 
-	instantAverageVoltage.WithLabelValues(source).Set(rec.InstantAverageVoltage)
+		if err := caps.skip(c); err != nil {
+			skipped++
+			if skipped == len(enabled) {
+				return nil, err
+			}
+			collected.WithLabelValues(c.name).Set(0)
+			degraded.Set(1)
+			zeros, err := skippedZeros(c)
+			if err != nil {
+				return nil, err
+			}
+			gatherers = append(gatherers, zeros)
+			continue
+		}
 
-	instantTotalCurrent := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: fmt.Sprintf("%s_instant_total_current", Prefix),
-			Help: "Frequency for source",
-		},
-		[]string{"source"},
-	)
+		reg := prometheus.NewRegistry()
+		if err := c.collect(ctx, target, reg); err != nil {
+			err = errors.Wrapf(err, "collecting %s", c.name)
+			if !caps.observe(c, err) && errorReason(err) != "auth" {
+				return nil, err
+			}
+			skipped++
+			if skipped == len(enabled) {
+				return nil, err
+			}
+			if errorReason(err) == "auth" {
+				slog.WarnContext(ctx, "Skipping collector, the gateway requires login for it", "target", target, "collector", c.name, "error", err)
+			} else {
+				slog.WarnContext(ctx, "Skipping collector, the gateway doesn't serve its endpoint", "target", target, "collector", c.name, "error", err)
+			}
+			collected.WithLabelValues(c.name).Set(0)
+			degraded.Set(1)
+			zeros, err := skippedZeros(c)
+			if err != nil {
+				return nil, err
+			}
+			gatherers = append(gatherers, zeros)
+			continue
+		}
 
-	if err := reg.Register(instantTotalCurrent); err != nil {
-		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
-			instantTotalCurrent = are.ExistingCollector.(*prometheus.GaugeVec)
-		} else {
-			return errors.Wrap(err, "handling instant_reactive_power metric already registered")
+		if err := countCollected(collected, c, reg); err != nil {
+			return nil, err
 		}
+		cacheResult(target, c, reg)
+		gatherers = append(gatherers, reg)
 	}
 
-	instantTotalCurrent.WithLabelValues(source).Set(rec.InstantTotalCurrent)
+	caps.store(ctx, target)
+	if err := caps.populate(enabled, summary); err != nil {
+		return nil, err
+	}
+
+	if *metricsCompat {
+		return compatGatherer{gatherers}, nil
+	}
+	return gatherers, nil
+}
+
+// skippedZeros returns what is exported for a skipped collector: zeros for
+// its metrics with -metrics.always-emit, otherwise nothing.
+func skippedZeros(c *collector) (prometheus.Gatherer, error) {
+	reg := prometheus.NewRegistry()
+	if !*alwaysEmit {
+		return reg, nil
+	}
+	if err := populateZeros(c, reg); err != nil {
+		return nil, errors.Wrapf(err, "exporting zeros for %s", c.name)
+	}
+	return reg, nil
+}
 
+// countCollected records how many metrics c produced in reg.
+func countCollected(collected *prometheus.GaugeVec, c *collector, reg prometheus.Gatherer) error {
+	families, err := reg.Gather()
+	if err != nil {
+		return errors.Wrapf(err, "gathering %s", c.name)
+	}
+	count := 0
+	for _, mf := range families {
+		count += len(mf.GetMetric())
+	}
+	collected.WithLabelValues(c.name).Set(float64(count))
 	return nil
+}
 
+// Prometheus treats any non-2xx probe as a failed scrape and discards the
+// body, so by default failures are reported in-band instead.
+var probeFailStatus = flag.String("probe.fail-status", "200", "How failed probes are answered: 200 serves tesla_powerwall_up 0, as Prometheus expects; 5xx answers 500, or 503 before the first background scrape, for monitoring that relies on HTTP status.")
+
+// failProbe answers a probe that couldn't be served, either with up=0 or
+// with status, according to -probe.fail-status.
+func failProbe(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if *probeFailStatus == "5xx" {
+		w.WriteHeader(status)
+		if msg != "" {
+			w.Write([]byte(msg))
+		}
+		return
+	}
+
+	h := promhttp.HandlerFor(upGatherer(0), promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	})
+	h.ServeHTTP(w, r)
 }
 
 func generateMetricHandler() func(w http.ResponseWriter, r *http.Request) {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		target := r.URL.Query().Get("target")
-		if target == "" {
+		// Every probe gets a request ID, returned in a header and attached
+		// to everything logged while serving it.
+		id := newRequestID()
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(withRequestID(r.Context(), id))
+		start := time.Now()
+		defer func() {
+			slog.DebugContext(r.Context(), "Probe finished", "query", r.URL.RawQuery, "duration", time.Since(start))
+		}()
+
+		targets := r.URL.Query()["target"]
+		if len(targets) == 0 || targets[0] == "" {
+			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte("You must provide a target parameter."))
+			return
+		}
+		for i, t := range targets {
+			targets[i] = normalizeTarget(t)
+			observeProbe(targets[i], time.Now())
+		}
+		target := targets[0]
+
+		// nocache=1 queries the gateway there and then, bypassing both
+		// background scrape results and cached slow collectors. Requests
+		// still go through the per-gateway rate limiter.
+		fresh := r.URL.Query().Get("nocache") == "1"
+
+		// collect=meters,soe runs just those collectors for this probe.
+		// Background scrapes run a fixed set, so such probes are always
+		// answered by querying the gateway.
+		only, err := parseCollectParam(r.URL.Query().Get("collect"))
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
 		}
 
-		status, err := queryMeters(target)
+		// Several targets are combined into one response, each gateway's
+		// metrics told apart by a target label.
+		if len(targets) > 1 {
+			reg, err := collectTargets(r.Context(), targets, fresh, only)
+			if err != nil {
+				failProbe(w, r, http.StatusInternalServerError, "")
+				return
+			}
+			h := promhttp.HandlerFor(reg, promhttp.HandlerOpts{
+				EnableOpenMetrics: true,
+			})
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if scraper != nil && scraper.handles(target) && !fresh && only == nil {
+			scraper.serve(target, w, r)
+			return
+		}
+
+		reg, err := collectTarget(r.Context(), target, fresh, only)
 		if err != nil {
-			log.Printf("%+v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Probe failed", "target", target, "error", err)
+			countProbeError(target, err)
+			failProbe(w, r, http.StatusInternalServerError, "")
+			return
 		}
 
-		reg := prometheus.NewRegistry()
+		h := promhttp.HandlerFor(prometheus.Gatherers{reg, upGatherer(1)}, promhttp.HandlerOpts{
+			EnableOpenMetrics: true,
+		})
+		h.ServeHTTP(w, r)
+
+	}
+}
+
+func main() {
+
+	flag.Parse()
+
+	if err := setupLogging(); err != nil {
+		fatal("Setting up logging failed", "error", err.Error())
+	}
+	go watchLogLevelSignals()
+
+	if err := applyProfile(*profile); err != nil {
+		fatal("Invalid -profile", "error", err)
+	}
+
+	if err := applyNameTemplate(*nameTemplate); err != nil {
+		fatal("Invalid -metric.name-template", "error", err)
+	}
 
-		if err = populateSource("site", status.Site, reg); err != nil {
-			log.Printf("%+v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+	client, err := newHTTPClient()
+	if err != nil {
+		fatal("Setting up HTTP client failed", "error", err)
+	}
+	httpClient = client
+
+	if *capabilities {
+		runCapabilities()
+	}
+
+	if *tz != "" {
+		loc, err := time.LoadLocation(*tz)
+		if err != nil {
+			fatal("Parsing -tz failed", "error", err)
 		}
+		tzLocation = loc
+	}
+
+	if *metricsCompat {
+		slog.Warn("-metrics.compat is set: renamed metrics are also emitted under their deprecated legacy names, which will be removed in a future release")
+	}
+
+	if *scrapeMaxConcurrency > 0 {
+		scrapeSlots = make(chan struct{}, *scrapeMaxConcurrency)
+	}
+
+	if *configFile != "" && *scrapeTargets != "" {
+		fatal("-config.file and -scrape.targets cannot be used together")
+	}
 
-		if err = populateSource("battery", status.Battery, reg); err != nil {
-			log.Printf("%+v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+	if *graphiteAddress != "" {
+		if *configFile == "" && *scrapeTargets == "" {
+			fatal("-graphite.address requires background scraping via -scrape.targets or -config.file")
 		}
-		if err = populateSource("load", status.Load, reg); err != nil {
-			log.Printf("%+v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+		graphite = newGraphiteWriter(*graphiteAddress, *graphitePrefix)
+	}
+
+	if *simulate {
+		if !*tlsInsecureSkipVerify {
+			fatal("-simulate requires -tls.insecure-skip-verify, the simulated gateway's certificate is self-signed")
 		}
-		if err = populateSource("solar", status.Solar, reg); err != nil {
-			log.Printf("%+v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+		address, err := startSimulator(*simulateSeed)
+		if err != nil {
+			fatal("Starting simulated gateway failed", "error", err)
 		}
+		simulatorAddress = address
+		slog.Info("Simulating a gateway", "target", simulatorTarget, "seed", *simulateSeed)
+	}
+
+	if *keepaliveInterval > 0 {
+		go runKeepalives(*keepaliveInterval)
+	}
 
-		soe, err := queryStateOfEnergy(target)
+	if *cloudTokenFile != "" {
+		c, err := newCloudClient(*cloudTokenFile)
 		if err != nil {
-			log.Printf("%+v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			fatal("Setting up cloud client failed", "error", err)
 		}
+		cloud = c
+	}
 
-		battery := prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name: fmt.Sprintf("%s_battery_percentage", Prefix),
-				Help: "Battery percentage of capacity",
-			},
-		)
+	if *stalenessClock != "exporter" && *stalenessClock != "gateway" {
+		fatal("-staleness.clock must be exporter or gateway", "value", *stalenessClock)
+	}
 
-		reg.Register(battery)
-		battery.Set(soe.Percentage)
+	if *gridChargingMinCharge < 0 || *gridChargingMinImport < 0 {
+		fatal("-grid-charging.min-charge-watts and -grid-charging.min-import-watts must not be negative")
+	}
 
-		h := promhttp.HandlerFor(reg, promhttp.HandlerOpts{
-			EnableOpenMetrics: true,
-		})
-		h.ServeHTTP(w, r)
+	if *frequencyBand <= 0 {
+		fatal("-frequency.band must be positive", "value", *frequencyBand)
+	}
 
+	if *frequencyNominal < 0 {
+		fatal("-frequency.nominal must not be negative", "value", *frequencyNominal)
 	}
-}
 
-func main() {
+	if *cloudCompareInterval <= 0 {
+		fatal("-cloud.compare-interval must be positive", "value", *cloudCompareInterval)
+	}
+	for _, c := range enabledCollectors() {
+		if c.name == "cloud_compare" && cloud == nil {
+			slog.Warn("-collect.cloud_compare has no effect without -cloud.token-file")
+		}
+	}
+
+	if *webStream {
+		if *configFile == "" && *scrapeTargets == "" {
+			fatal("-web.stream requires background scraping via -scrape.targets or -config.file")
+		}
+		broker = newStreamBroker()
+	}
+
+	if *alwaysEmit && *freshnessMaxAge > 0 {
+		fatal("-metrics.always-emit and -freshness.max-age are mutually exclusive: one keeps every series, the other hides stale ones")
+	}
+
+	if *probeUnknownCollectors != "error" && *probeUnknownCollectors != "ignore" {
+		fatal("-probe.unknown-collectors must be error or ignore", "value", *probeUnknownCollectors)
+	}
+
+	if *expectedPowerwalls < 0 {
+		fatal("-powerwalls.expected must not be negative", "value", *expectedPowerwalls)
+	}
+
+	if *capabilitiesRecheckInterval < 0 {
+		fatal("-capabilities.recheck-interval must not be negative", "value", *capabilitiesRecheckInterval)
+	}
+
+	if *probeFailStatus != "200" && *probeFailStatus != "5xx" {
+		fatal("-probe.fail-status must be 200 or 5xx", "value", *probeFailStatus)
+	}
+
+	if *solarClippingThreshold > 0 && *solarCapacityWatts <= 0 {
+		fatal("-solar.clipping-threshold requires -solar.capacity-watts")
+	}
+
+	if *powerWindowEnabled && *configFile == "" && *scrapeTargets == "" {
+		fatal("-metrics.power-window requires background scraping via -scrape.targets or -config.file")
+	}
 
-	promhttp.HandlerFor(
+	if *backupLoadWindow < 0 {
+		fatal("-backup.load-window must not be negative", "value", *backupLoadWindow)
+	}
+
+	if *backupLoadWindow > 0 && *configFile == "" && *scrapeTargets == "" {
+		fatal("-backup.load-window requires background scraping via -scrape.targets or -config.file")
+	}
+
+	if *holdLast > 0 && *configFile == "" && *scrapeTargets == "" {
+		fatal("-metrics.hold-last requires background scraping via -scrape.targets or -config.file")
+	}
+
+	if *pushGateway != "" {
+		targets := parseTargets(*scrapeTargets)
+		if *configFile != "" {
+			c, err := loadConfig(*configFile)
+			if err != nil {
+				fatal("Loading configuration failed", "file", *configFile, "error", err)
+			}
+			config = c
+			targets = c.addresses()
+		}
+		if len(targets) == 0 {
+			fatal("-push.gateway requires targets via -scrape.targets or -config.file")
+		}
+		runPush(targets)
+	}
+
+	if *configFile != "" {
+		scraper = newBackgroundScraper(*scrapeInterval)
+		if err := reloadConfig(); err != nil {
+			fatal("Loading configuration failed", "file", *configFile, "error", err)
+		}
+		go watchConfigReloads()
+	} else if *scrapeTargets != "" {
+		scraper = newBackgroundScraper(*scrapeInterval)
+		scraper.setTargets(parseTargets(*scrapeTargets))
+	}
+
+	if err := validatePaths(); err != nil {
+		fatal("Invalid web path", "error", err)
+	}
+	if err := validateAdminAddress(); err != nil {
+		fatal("Invalid admin listen address", "error", err)
+	}
+
+	if *startupVerify && scraper == nil {
+		fatal("-startup.verify requires background scraping via -scrape.targets or -config.file")
+	}
+	if scraper != nil {
+		if *startupVerify {
+			if !verifyStartup() {
+				fatal("No target could be scraped at startup")
+			}
+		} else {
+			go verifyStartup()
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(*telemetryPath, promhttp.HandlerFor(
 		prometheus.DefaultGatherer,
 		promhttp.HandlerOpts{
 			// Opt into OpenMetrics to support exemplars.
 			EnableOpenMetrics: true,
 		},
-	)
-	http.HandleFunc("/probe", generateMetricHandler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	))
+	mux.HandleFunc(*telemetryPath+"/list", metricListHandler)
+	mux.HandleFunc("/dashboard.json", dashboardHandler)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
 
-	log.Println("Listening on 0.0.0.0:8080")
-	log.Fatal(http.ListenAndServe("0.0.0.0:8080", nil))
+	servers := map[string]http.Handler{}
+	if *listenAddress != "" {
+		servers[*listenAddress] = mux
+	}
+	if *unixSocket != "" {
+		servers[unixAddressPrefix+*unixSocket] = mux
+	}
+	if len(servers) == 0 {
+		fatal("Nothing to listen on: set -web.listen-address or -web.unix-socket")
+	}
+
+	probeMux := mux
+	if *probeListenAddress != "" && *probeListenAddress != *listenAddress {
+		probeMux = http.NewServeMux()
+		probeMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		servers[*probeListenAddress] = probeMux
+	}
+	probeMux.HandleFunc(*probePath, trackInFlight(generateMetricHandler()))
+	if broker != nil {
+		probeMux.HandleFunc("/stream", broker.serveStream)
+	}
+	if *adminListenAddress != "" {
+		creds, err := loadAdminCredentials()
+		if err != nil {
+			fatal("Loading admin credentials failed", "error", err)
+		}
+		servers[*adminListenAddress] = newAdminMux(creds)
+	}
+
+	if err := serve(servers); err != nil {
+		fatal("HTTP server failed", "error", err)
+	}
 }
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// gathered returns the value of every series of the metric name in g,
+// keyed by its labels as "name=value" pairs joined with commas.
+func gathered(t *testing.T, g prometheus.Gatherer, name string) map[string]float64 {
+	t.Helper()
+
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatalf("Gather() failed: %v", err)
+	}
+
+	values := map[string]float64{}
+	for _, mf := range families {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			var labels []string
+			for _, pair := range m.GetLabel() {
+				labels = append(labels, pair.GetName()+"="+pair.GetValue())
+			}
+			sort.Strings(labels)
+
+			var value float64
+			switch {
+			case m.Gauge != nil:
+				value = m.GetGauge().GetValue()
+			case m.Counter != nil:
+				value = m.GetCounter().GetValue()
+			case m.Untyped != nil:
+				value = m.GetUntyped().GetValue()
+			}
+			values[strings.Join(labels, ",")] = value
+		}
+	}
+	return values
+}
+
+// setFlag sets a flag variable for the rest of the test.
+func setFlag[T any](t *testing.T, p *T, value T) {
+	t.Helper()
+	old := *p
+	*p = value
+	t.Cleanup(func() { *p = old })
+}
+
+func TestInstantTotalCurrent(t *testing.T) {
+	tests := []struct {
+		name      string
+		current   float64
+		magnitude float64
+	}{
+		{"positive", 3.3, 3.3},
+		{"negative", -5, 5},
+		{"zero", 0, 0},
+	}
+
+	for _, derived := range []bool{false, true} {
+		setFlag(t, derivedMetrics, derived)
+		for _, tt := range tests {
+			reg := prometheus.NewRegistry()
+			if err := populateSource("site", Record{InstantTotalCurrent: tt.current}, reg); err != nil {
+				t.Fatalf("%s: populateSource failed: %v", tt.name, err)
+			}
+
+			raw := gathered(t, reg, instantTotalCurrentMetric.Name)
+			if got, ok := raw["source=site"]; !ok || got != tt.current {
+				t.Errorf("%s: %s = %v (present %v), want %v", tt.name, instantTotalCurrentMetric.Name, got, ok, tt.current)
+			}
+
+			magnitude := gathered(t, reg, instantTotalCurrentMagnitudeMetric.Name)
+			got, ok := magnitude["source=site"]
+			switch {
+			case !derived && ok:
+				t.Errorf("%s: %s exported without -metrics.derived", tt.name, instantTotalCurrentMagnitudeMetric.Name)
+			case derived && (!ok || got != tt.magnitude):
+				t.Errorf("%s: %s = %v (present %v), want %v", tt.name, instantTotalCurrentMagnitudeMetric.Name, got, ok, tt.magnitude)
+			}
+		}
+	}
+}
+
+func TestAPIURL(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"192.168.1.50", "https://192.168.1.50/api/meters/aggregates"},
+		{"192.168.1.50:8443", "https://192.168.1.50:8443/api/meters/aggregates"},
+		{"powerwall.local", "https://powerwall.local/api/meters/aggregates"},
+		{"powerwall.local:8443", "https://powerwall.local:8443/api/meters/aggregates"},
+		{"fe80::1", "https://[fe80::1]/api/meters/aggregates"},
+		{"2001:db8::50", "https://[2001:db8::50]/api/meters/aggregates"},
+		{"[fe80::1]", "https://[fe80::1]/api/meters/aggregates"},
+		{"[fe80::1]:8443", "https://[fe80::1]:8443/api/meters/aggregates"},
+	}
+
+	for _, tt := range tests {
+		if got := apiURL(tt.host, "/api/meters/aggregates"); got != tt.want {
+			t.Errorf("apiURL(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestIPv6Target(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	gw := newMockGateway(t, "")
+	gw.set("/api/system_status/soe", mockResponse{contentType: "application/json", body: `{"percentage":81.38916}`})
+	srv := httptest.NewUnstartedServer(gw)
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.StartTLS()
+	target := strings.TrimPrefix(srv.URL, "https://")
+	t.Cleanup(func() {
+		srv.Close()
+		forgetTarget(target)
+	})
+
+	soe, err := queryStateOfEnergy(context.Background(), target)
+	if err != nil {
+		t.Fatalf("querying %s failed: %v", target, err)
+	}
+	if soe.Percentage != 81.38916 {
+		t.Errorf("percentage from %s = %v, want 81.38916", target, soe.Percentage)
+	}
+}
+
+func TestErrorEnvelopes(t *testing.T) {
+	tests := []struct {
+		file string
+		// status is what the gateway answers with the envelope.
+		status int
+		// code is the envelope's code after queryAPI, or 0 if the file
+		// isn't an envelope.
+		code   int
+		reason string
+	}{
+		{"not-found.json", http.StatusOK, http.StatusNotFound, "http_status"},
+		{"not-found.json", http.StatusNotFound, http.StatusNotFound, "http_status"},
+		{"login-error.json", http.StatusOK, http.StatusUnauthorized, "auth"},
+		{"login-error.json", http.StatusUnauthorized, http.StatusUnauthorized, "auth"},
+		{"forbidden.json", http.StatusForbidden, http.StatusForbidden, "auth"},
+		{"no-code.json", http.StatusOK, 0, "http_status"},
+		{"no-code.json", http.StatusServiceUnavailable, http.StatusServiceUnavailable, "http_status"},
+		{"not-an-envelope-array.json", http.StatusOK, 0, ""},
+		{"not-an-envelope-data.json", http.StatusOK, 0, ""},
+	}
+
+	gw := newMockGateway(t, "")
+	for _, tt := range tests {
+		body, err := os.ReadFile(filepath.Join("testdata", "envelopes", tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		isEnvelope := tt.reason != ""
+		if got := parseAPIError(body); (got != nil) != isEnvelope {
+			t.Errorf("%s: parseAPIError() = %v, want an envelope: %v", tt.file, got, isEnvelope)
+		}
+
+		gw.set("/api/test", mockResponse{status: tt.status, contentType: "application/json", body: string(body)})
+		var v interface{}
+		err = queryAPI(context.Background(), gw.target(), "/api/test", &v)
+		if !isEnvelope {
+			if err != nil {
+				t.Errorf("%s: queryAPI failed: %v", tt.file, err)
+			}
+			continue
+		}
+
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			t.Errorf("%s with HTTP %d: error %v is not an APIError", tt.file, tt.status, err)
+			continue
+		}
+		if apiErr.Code != tt.code {
+			t.Errorf("%s with HTTP %d: code = %d, want %d", tt.file, tt.status, apiErr.Code, tt.code)
+		}
+		if got := errorReason(err); got != tt.reason {
+			t.Errorf("%s with HTTP %d: errorReason(%v) = %q, want %q", tt.file, tt.status, err, got, tt.reason)
+		}
+	}
+}
+
+func TestProbeCancelled(t *testing.T) {
+	gw := newMockGateway(t, "")
+	entered := make(chan struct{})
+	gw.set("/api/meters/aggregates", mockResponse{handler: func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/probe?target="+gw.target(), nil).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		generateMetricHandler()(httptest.NewRecorder(), req)
+		close(done)
+	}()
+
+	<-entered
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("probe still running 2s after its request was cancelled")
+	}
+}
+
+// counterValue returns the current value of c's series with labels.
+func counterValue(t *testing.T, c *prometheus.CounterVec, labels ...string) float64 {
+	t.Helper()
+
+	var m dto.Metric
+	if err := c.WithLabelValues(labels...).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestHTMLLoginPage(t *testing.T) {
+	const path = "/api/system_status/soe"
+	gw := newMockGateway(t, "")
+	gw.set(path, mockResponse{
+		contentType: "text/html; charset=utf-8",
+		body:        "<!DOCTYPE html><html><head><title>Login</title></head><body><form action=\"/login\"></form></body></html>",
+	})
+
+	before := counterValue(t, unexpectedContentType, path)
+	_, err := queryStateOfEnergy(context.Background(), gw.target())
+	if err == nil {
+		t.Fatal("query of an HTML login page succeeded")
+	}
+	if !errors.Is(err, errUnexpectedContentType) {
+		t.Errorf("error %v is not %v", err, errUnexpectedContentType)
+	}
+	if got := errorReason(err); got != "parse" {
+		t.Errorf("errorReason(%v) = %q, want parse", err, got)
+	}
+	if got := counterValue(t, unexpectedContentType, path) - before; got != 1 {
+		t.Errorf("unexpected content type count for %s went up by %v, want 1", path, got)
+	}
+
+	// The probe queries meters first, so fails there.
+	gw.set("/api/meters/aggregates", mockResponse{contentType: "text/html", body: "<!DOCTYPE html><html></html>"})
+	before = counterValue(t, probeErrors, gw.target(), "parse")
+	rec := probe(t, url.Values{"target": {gw.target()}})
+	if got, ok := gathered(t, parsed(t, rec), upMetric.Name)[""]; !ok || got != 0 {
+		t.Errorf("%s = %v (present %v), want 0", upMetric.Name, got, ok)
+	}
+	if got := counterValue(t, probeErrors, gw.target(), "parse") - before; got != 1 {
+		t.Errorf("parse probe errors went up by %v, want 1", got)
+	}
+}
+
+// probe sends a probe with query to the probe handler and returns the
+// response.
+func probe(t *testing.T, query url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/probe?"+query.Encode(), nil)
+	rec := httptest.NewRecorder()
+	generateMetricHandler()(rec, req)
+	return rec
+}
+
+// parsed returns a gatherer for the metrics in a probe response, so they
+// can be read with gathered.
+func parsed(t *testing.T, rec *httptest.ResponseRecorder) prometheus.Gatherer {
+	t.Helper()
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(strings.NewReader(rec.Body.String()))
+	if err != nil {
+		t.Fatalf("parsing probe response failed: %v\n%s", err, rec.Body.String())
+	}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		var list []*dto.MetricFamily
+		for _, mf := range families {
+			list = append(list, mf)
+		}
+		return list, nil
+	})
+}
+
+func TestProbeHandler(t *testing.T) {
+	tests := []struct {
+		firmware string
+		metric   *metricDef
+		labels   string
+		want     float64
+	}{
+		{"20.49.0", instantPowerMetric, "source=solar", 800},
+		{"20.49.0", instantApparentPowerMetric, "source=load", 3422.35},
+		{"20.49.0", batteryPercentageMetric, "", 54.8},
+		{"20.49.0", gridStatusMetric, "status=SystemGridConnected", 1},
+		{"20.49.0", degradedMetric, "", 0},
+		{"23.44.0", instantPowerMetric, "source=solar", 7000},
+		{"23.44.0", instantApparentPowerMetric, "source=load", 1702.56},
+		{"23.44.0", batteryPercentageMetric, "", 81.38916},
+		{"23.44.0", gridServicesActiveMetric, "", 1},
+		{"23.44.0", metricsCollectedMetric, "collector=soe", 1},
+	}
+
+	gateways := map[string]*mockGateway{}
+	for _, firmware := range firmwares {
+		gateways[firmware] = newMockGateway(t, firmware)
+	}
+
+	for _, tt := range tests {
+		rec := probe(t, url.Values{"target": {gateways[tt.firmware].target()}})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: probe answered %d: %s", tt.firmware, rec.Code, rec.Body.String())
+		}
+		got, ok := gathered(t, parsed(t, rec), tt.metric.Name)[tt.labels]
+		if !ok || got != tt.want {
+			t.Errorf("%s: %s{%s} = %v (present %v), want %v", tt.firmware, tt.metric.Name, tt.labels, got, ok, tt.want)
+		}
+	}
+}
+
+func TestProbeHandlerAuthRequired(t *testing.T) {
+	gw := newMockGateway(t, "auth-required")
+
+	// Every default collector needs login, so the probe fails.
+	rec := probe(t, url.Values{"target": {gw.target()}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("probe answered %d, want 200", rec.Code)
+	}
+	if got, ok := gathered(t, parsed(t, rec), upMetric.Name)[""]; !ok || got != 0 {
+		t.Errorf("%s = %v (present %v), want 0", upMetric.Name, got, ok)
+	}
+
+	// With a collector that doesn't need login, the rest are skipped and
+	// the scrape is marked degraded.
+	rec = probe(t, url.Values{"target": {gw.target()}, "collect": {"meters,status"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("probe answered %d, want 200", rec.Code)
+	}
+	g := parsed(t, rec)
+	if got := gathered(t, g, degradedMetric.Name)[""]; got != 1 {
+		t.Errorf("%s = %v, want 1", degradedMetric.Name, got)
+	}
+	if got := gathered(t, g, gatewayInfoMetric.Name)["device_type=teg,din=1232100-10-J--TG000000000020,version=24.4.0 0fe780c9"]; got != 1 {
+		t.Errorf("%s = %v, want 1", gatewayInfoMetric.Name, got)
+	}
+}
+
+func TestNormalizeTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"192.168.1.50", "192.168.1.50"},
+		{"192.168.1.50:8443", "192.168.1.50:8443"},
+		{"powerwall.local", "powerwall.local"},
+		{"fe80::1", "fe80::1"},
+		{"[fe80::1]", "[fe80::1]"},
+		{"[fe80::1]:8443", "[fe80::1]:8443"},
+		{"https://192.168.1.50", "192.168.1.50"},
+		{"https://192.168.1.50/", "192.168.1.50"},
+		{"http://192.168.1.50:8443/api", "192.168.1.50:8443"},
+		{"https://[fe80::1]/", "[fe80::1]"},
+		{"https://[fe80::1]:8443", "[fe80::1]:8443"},
+		{"https://", "https://"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeTarget(tt.target); got != tt.want {
+			t.Errorf("normalizeTarget(%q) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestSchemedTargets(t *testing.T) {
+	gw := newMockGateway(t, "20.49.0")
+
+	for _, target := range []string{
+		gw.target(),
+		"https://" + gw.target(),
+		"https://" + gw.target() + "/",
+		"http://" + gw.target(),
+	} {
+		rec := probe(t, url.Values{"target": {target}})
+		if rec.Code != http.StatusOK {
+			t.Errorf("probe of %s answered %d: %s", target, rec.Code, rec.Body.String())
+			continue
+		}
+		if got, ok := gathered(t, parsed(t, rec), batteryPercentageMetric.Name)[""]; !ok || got != 54.8 {
+			t.Errorf("probe of %s: %s = %v (present %v), want 54.8", target, batteryPercentageMetric.Name, got, ok)
+		}
+	}
+
+	statesMu.Lock()
+	for target := range states {
+		if strings.Contains(target, "://") {
+			t.Errorf("state kept under the unnormalized target %s", target)
+		}
+	}
+	statesMu.Unlock()
+
+	got := parseTargets("https://192.168.1.50/, 192.168.1.51 ,,http://[fe80::1]:8443")
+	want := []string{"192.168.1.50", "192.168.1.51", "[fe80::1]:8443"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("parseTargets() = %q, want %q", got, want)
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	tests := []struct {
+		base     string
+		path     string
+		endpoint string
+		url      string
+	}{
+		{"", "/api/meters/aggregates", "/api/meters/aggregates", "https://192.168.1.50/api/meters/aggregates"},
+		{"/powerwall", "/powerwall/api/meters/aggregates", "/api/meters/aggregates", "https://192.168.1.50/powerwall/api/meters/aggregates"},
+		{"powerwall/", "/powerwall/api/meters/aggregates", "/api/meters/aggregates", "https://192.168.1.50/powerwall/api/meters/aggregates"},
+		{"/home/powerwall/", "/home/powerwall/api/meters/aggregates", "/api/meters/aggregates", "https://192.168.1.50/home/powerwall/api/meters/aggregates"},
+	}
+
+	for _, tt := range tests {
+		setFlag(t, apiBasePath, tt.base)
+		if got := withBasePath("/api/meters/aggregates"); got != tt.path {
+			t.Errorf("base %q: withBasePath() = %q, want %q", tt.base, got, tt.path)
+		}
+		if got := apiEndpoint(tt.path); got != tt.endpoint {
+			t.Errorf("base %q: apiEndpoint(%q) = %q, want %q", tt.base, tt.path, got, tt.endpoint)
+		}
+		if got := apiURL("192.168.1.50", "/api/meters/aggregates"); got != tt.url {
+			t.Errorf("base %q: apiURL() = %q, want %q", tt.base, got, tt.url)
+		}
+	}
+
+	// A path outside the base path is left alone.
+	setFlag(t, apiBasePath, "/powerwall")
+	if got := apiEndpoint("/powerwallx/api/status"); got != "/powerwallx/api/status" {
+		t.Errorf("apiEndpoint(/powerwallx/api/status) = %q, want it unchanged", got)
+	}
+}
+
+func TestBasePathProbe(t *testing.T) {
+	gw := newMockGateway(t, "")
+	for path, resp := range loadFirmware(t, "23.44.0") {
+		gw.set("/powerwall"+path, resp)
+	}
+
+	for _, tt := range []struct {
+		base string
+		code int
+		up   float64
+	}{
+		{"/powerwall", http.StatusOK, 1},
+		{"", http.StatusOK, 0},
+	} {
+		setFlag(t, apiBasePath, tt.base)
+		rec := probe(t, url.Values{"target": {gw.target()}})
+		if rec.Code != tt.code {
+			t.Fatalf("base %q: probe answered %d: %s", tt.base, rec.Code, rec.Body.String())
+		}
+		g := parsed(t, rec)
+		if got := gathered(t, g, upMetric.Name)[""]; got != tt.up {
+			t.Errorf("base %q: %s = %v, want %v", tt.base, upMetric.Name, got, tt.up)
+		}
+		if tt.up == 1 {
+			if got := gathered(t, g, batteryPercentageMetric.Name)[""]; got != 81.38916 {
+				t.Errorf("base %q: %s = %v, want 81.38916", tt.base, batteryPercentageMetric.Name, got)
+			}
+		}
+	}
+	if n := gw.requested("/powerwall/api/meters/aggregates"); n != 1 {
+		t.Errorf("/powerwall/api/meters/aggregates requested %d times, want 1", n)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// targetLabel is added to every metric when one probe covers several
+// gateways, so that each gateway's sources stay distinct series.
+const targetLabel = "target"
+
+// labelGatherer adds a fixed set of labels to everything gathered from g.
+// It fails rather than overwrite a label a metric already has.
+type labelGatherer struct {
+	labels map[string]string
+	g      prometheus.Gatherer
+}
+
+func (l labelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := l.g.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			for _, pair := range m.GetLabel() {
+				if _, ok := l.labels[pair.GetName()]; ok {
+					return nil, errors.Errorf("metric %s already has a %q label", mf.GetName(), pair.GetName())
+				}
+			}
+			for name, value := range l.labels {
+				m.Label = append(m.Label, &dto.LabelPair{
+					Name:  proto.String(name),
+					Value: proto.String(value),
+				})
+			}
+			sort.Slice(m.Label, func(i, j int) bool {
+				return m.Label[i].GetName() < m.Label[j].GetName()
+			})
+		}
+	}
+	return families, nil
+}
+
+// sourceGatherer drops metrics gathered from g whose source label isn't one
+// of sources. They are left out on purpose, so they stay out even with
+// -metrics.always-emit. Metrics without a source label are kept.
+type sourceGatherer struct {
+	sources []string
+	g       prometheus.Gatherer
+}
+
+func (s sourceGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := s.g.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	keep := map[string]bool{}
+	for _, source := range s.sources {
+		keep[source] = true
+	}
+
+	var filtered []*dto.MetricFamily
+	for _, mf := range families {
+		var metrics []*dto.Metric
+		for _, m := range mf.GetMetric() {
+			if source, ok := labelValue(m, "source"); !ok || keep[source] {
+				metrics = append(metrics, m)
+			}
+		}
+		if len(metrics) > 0 {
+			mf.Metric = metrics
+			filtered = append(filtered, mf)
+		}
+	}
+	return filtered, nil
+}
+
+// labelValue returns the value of m's label called name, if it has one.
+func labelValue(m *dto.Metric, name string) (string, bool) {
+	for _, pair := range m.GetLabel() {
+		if pair.GetName() == name {
+			return pair.GetValue(), true
+		}
+	}
+	return "", false
+}
+
+// gatherTarget returns the metrics for a single target, with
+// tesla_powerwall_up, from its background scrape if it has one and no
+// collectors were picked for the probe.
+func gatherTarget(ctx context.Context, target string, fresh bool, only []*collector) (prometheus.Gatherer, error) {
+	if scraper != nil && scraper.handles(target) && !fresh && only == nil {
+		return scraper.gatherer(target)
+	}
+	reg, err := collectTarget(ctx, target, fresh, only)
+	if err != nil {
+		return nil, err
+	}
+	return prometheus.Gatherers{reg, upGatherer(1)}, nil
+}
+
+// collectTargets gathers several targets at once, labelling each one's
+// metrics with its target. Targets that fail are logged and left out but
+// for tesla_powerwall_up 0; it only fails if every target does.
+func collectTargets(ctx context.Context, targets []string, fresh bool, only []*collector) (prometheus.Gatherer, error) {
+	results := make([]prometheus.Gatherer, len(targets))
+	errs := make([]error, len(targets))
+
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target string) {
+			defer wg.Done()
+			results[i], errs[i] = gatherTarget(ctx, target, fresh, only)
+		}(i, target)
+	}
+	wg.Wait()
+
+	var gatherers prometheus.Gatherers
+	failed := 0
+	for i, target := range targets {
+		g := results[i]
+		if errs[i] != nil {
+			slog.ErrorContext(ctx, "Probe failed", "target", target, "error", errs[i])
+			countProbeError(target, errs[i])
+			g = upGatherer(0)
+			failed++
+		}
+		gatherers = append(gatherers, labelGatherer{
+			labels: map[string]string{targetLabel: target},
+			g:      g,
+		})
+	}
+	if failed == len(targets) {
+		return nil, errors.New("all targets failed")
+	}
+	return gatherers, nil
+}
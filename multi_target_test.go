@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMultiTargetProbe(t *testing.T) {
+	old := newMockGateway(t, "20.49.0")
+	current := newMockGateway(t, "23.44.0")
+	query := url.Values{"target": {old.target(), current.target()}}
+
+	tests := []struct {
+		name   string
+		labels string
+		want   map[string]float64
+	}{
+		{instantPowerMetric.Name, "source=solar", map[string]float64{old.target(): 800, current.target(): 7000}},
+		{batteryPercentageMetric.Name, "", map[string]float64{old.target(): 54.8, current.target(): 81.38916}},
+		{instantTotalCurrentMetric.Name, "source=battery", map[string]float64{old.target(): -4.5, current.target(): -12.14}},
+		{upMetric.Name, "", map[string]float64{old.target(): 1, current.target(): 1}},
+	}
+
+	for _, compat := range []bool{false, true} {
+		setFlag(t, metricsCompat, compat)
+
+		rec := probe(t, query)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("compat %v: probe answered %d: %s", compat, rec.Code, rec.Body.String())
+		}
+		g := parsed(t, rec)
+
+		checks := tests
+		if compat {
+			legacy := tests[2]
+			legacy.name = instantTotalCurrentMetric.Legacy
+			checks = append(checks[:len(checks):len(checks)], legacy)
+		}
+		for _, tt := range checks {
+			got := gathered(t, g, tt.name)
+			for target, want := range tt.want {
+				labels := targetLabel + "=" + target
+				if tt.labels != "" {
+					labels = tt.labels + "," + labels
+				}
+				if v, ok := got[labels]; !ok || v != want {
+					t.Errorf("compat %v: %s{%s} = %v (present %v), want %v", compat, tt.name, labels, v, ok, want)
+				}
+			}
+			for labels := range got {
+				if !hasTargetLabel(labels) {
+					t.Errorf("compat %v: %s{%s} has no target label", compat, tt.name, labels)
+				}
+			}
+		}
+
+		if !compat {
+			if got := gathered(t, g, instantTotalCurrentMetric.Legacy); len(got) > 0 {
+				t.Errorf("%s exported without -metrics.compat", instantTotalCurrentMetric.Legacy)
+			}
+		}
+	}
+}
+
+// hasTargetLabel reports whether labels, as keyed by gathered, include a
+// target label.
+func hasTargetLabel(labels string) bool {
+	for _, pair := range strings.Split(labels, ",") {
+		if strings.HasPrefix(pair, targetLabel+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSourceGatherer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	power, err := instantPowerMetric.gaugeVec(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	power.WithLabelValues("site").Set(100)
+	power.WithLabelValues("solar").Set(200)
+	percentage, err := batteryPercentageMetric.gauge(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	percentage.Set(80)
+	g := sourceGatherer{sources: []string{"site"}, g: reg}
+
+	for _, emit := range []bool{false, true} {
+		setFlag(t, alwaysEmit, emit)
+
+		got := gathered(t, g, instantPowerMetric.Name)
+		if len(got) != 1 || got["source=site"] != 100 {
+			t.Errorf("always-emit %v: %s = %v, want only source=site at 100", emit, instantPowerMetric.Name, got)
+		}
+		if got := gathered(t, g, batteryPercentageMetric.Name)[""]; got != 80 {
+			t.Errorf("always-emit %v: %s = %v, want 80", emit, batteryPercentageMetric.Name, got)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+const defaultNameTemplate = "{{.Prefix}}_{{.Name}}"
+
+var nameTemplate = flag.String("metric.name-template", defaultNameTemplate, "Go template for the names of gateway metrics on /probe. Available fields: .Prefix, .Name, .Collector and .Unit.")
+
+// metricNameFields is what -metric.name-template is executed against.
+type metricNameFields struct {
+	Prefix    string
+	Name      string
+	Collector string
+	Unit      string
+}
+
+// applyNameTemplate renames every /probe metric in the catalog using text.
+// It must run before any collector registers its metrics. The exporter's own
+// metrics on /metrics keep their names, since they are created at startup
+// and aren't part of a gateway's data.
+func applyNameTemplate(text string) error {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return errors.Wrap(err, "parsing metric name template")
+	}
+
+	names := map[string]string{}
+	renamed := map[*metricDef]string{}
+	for _, d := range catalog {
+		if d.Path != "/probe" {
+			continue
+		}
+
+		var buf bytes.Buffer
+		err := tmpl.Execute(&buf, metricNameFields{
+			Prefix:    Prefix,
+			Name:      d.base,
+			Collector: d.Collector,
+			Unit:      d.Unit,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "expanding metric name template for %s", d.Name)
+		}
+
+		name := buf.String()
+		if !model.IsValidMetricName(model.LabelValue(name)) {
+			return errors.Errorf("metric name template produces invalid name %q for %s", name, d.Name)
+		}
+		if other, ok := names[name]; ok {
+			return errors.Errorf("metric name template produces %q for both %s and %s", name, other, d.Name)
+		}
+		names[name] = d.Name
+		renamed[d] = name
+	}
+
+	for d, name := range renamed {
+		d.Name = name
+	}
+	return nil
+}
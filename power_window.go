@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var powerWindowEnabled = flag.Bool("metrics.power-window", false, "Export the minimum, maximum and average instant power of each source over the background scrapes since the previous probe. Requires background scraping, ideally at a shorter -scrape.interval than Prometheus's.")
+
+var (
+	instantPowerMinMetric = defineMetric(metricDef{
+		Name:      "instant_power_min",
+		Type:      "gauge",
+		Unit:      "watts",
+		Help:      "Lowest instant power of each source seen by background scrapes since the previous probe",
+		Labels:    []string{"source"},
+		Collector: "meters",
+		Requires:  "-metrics.power-window",
+	})
+	instantPowerMaxMetric = defineMetric(metricDef{
+		Name:      "instant_power_max",
+		Type:      "gauge",
+		Unit:      "watts",
+		Help:      "Highest instant power of each source seen by background scrapes since the previous probe",
+		Labels:    []string{"source"},
+		Collector: "meters",
+		Requires:  "-metrics.power-window",
+	})
+	instantPowerAvgMetric = defineMetric(metricDef{
+		Name:      "instant_power_avg",
+		Type:      "gauge",
+		Unit:      "watts",
+		Help:      "Average instant power of each source over background scrapes since the previous probe",
+		Labels:    []string{"source"},
+		Collector: "meters",
+		Requires:  "-metrics.power-window",
+	})
+	powerWindowSamplesMetric = defineMetric(metricDef{
+		Name:      "instant_power_window_samples",
+		Type:      "gauge",
+		Help:      "Number of readings behind instant_power_min, _max and _avg",
+		Labels:    []string{"source"},
+		Collector: "meters",
+		Requires:  "-metrics.power-window",
+	})
+)
+
+// powerWindow summarises the instant power readings of one source between
+// two probes.
+type powerWindow struct {
+	min, max, sum float64
+	count         int
+	last          float64
+}
+
+func (w *powerWindow) add(v float64) {
+	if w.count == 0 || v < w.min {
+		w.min = v
+	}
+	if w.count == 0 || v > w.max {
+		w.max = v
+	}
+	w.sum += v
+	w.count++
+	w.last = v
+}
+
+// reset starts a new window from the latest reading, so a probe that
+// arrives before the next background scrape still sees the current value
+// rather than nothing.
+func (w *powerWindow) reset() {
+	*w = powerWindow{min: w.last, max: w.last, sum: w.last, count: 1, last: w.last}
+}
+
+// recordPowerWindow adds the instant power of every source in status to
+// host's windows. Stale sources are left out, like their instant power.
+func recordPowerWindow(host string, status *PowerwallStatus) {
+	state := stateFor(host)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.powerWindows == nil {
+		state.powerWindows = map[string]*powerWindow{}
+	}
+	for source, rec := range status.Records() {
+		if *freshnessMaxAge > 0 && sourceStale(rec) {
+			continue
+		}
+		w, ok := state.powerWindows[source]
+		if !ok {
+			w = &powerWindow{}
+			state.powerWindows[source] = w
+		}
+		w.add(rec.InstantPower)
+	}
+}
+
+// takePowerWindow returns the power window metrics for target and starts
+// new windows. Every probe takes its own window, so two Prometheus servers
+// probing the same target each see the readings since the other's probe.
+func takePowerWindow(target string) (prometheus.Gatherer, error) {
+	reg := prometheus.NewRegistry()
+	minPower, err := instantPowerMinMetric.gaugeVec(reg)
+	if err != nil {
+		return nil, err
+	}
+	maxPower, err := instantPowerMaxMetric.gaugeVec(reg)
+	if err != nil {
+		return nil, err
+	}
+	avgPower, err := instantPowerAvgMetric.gaugeVec(reg)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := powerWindowSamplesMetric.gaugeVec(reg)
+	if err != nil {
+		return nil, err
+	}
+
+	state := stateFor(target)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	for source, w := range state.powerWindows {
+		if w.count == 0 {
+			continue
+		}
+		minPower.WithLabelValues(source).Set(w.min)
+		maxPower.WithLabelValues(source).Set(w.max)
+		avgPower.WithLabelValues(source).Set(w.sum / float64(w.count))
+		samples.WithLabelValues(source).Set(float64(w.count))
+		w.reset()
+	}
+	return reg, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var expectedPowerwalls = flag.Int("powerwalls.expected", 0, "Number of Powerwalls each gateway should report on /api/powerwalls, for the powerwalls collector. A target's expected_powerwalls in -config.file overrides it. 0 means no expectation.")
+
+// Powerwalls is the response from /api/powerwalls, which lists the battery
+// units the gateway can currently see.
+type Powerwalls struct {
+	Powerwalls []struct {
+		PackageSerialNumber string `json:"PackageSerialNumber"`
+	} `json:"powerwalls"`
+}
+
+var (
+	countMetric = defineMetric(metricDef{
+		Name:      "count",
+		Type:      "gauge",
+		Help:      "Number of Powerwalls the gateway currently reports",
+		Collector: "powerwalls",
+	})
+	countExpectedMetric = defineMetric(metricDef{
+		Name:      "count_expected",
+		Type:      "gauge",
+		Help:      "Number of Powerwalls the gateway is expected to report; absent if no expectation is configured",
+		Collector: "powerwalls",
+	})
+	countMatchesExpectedMetric = defineMetric(metricDef{
+		Name:      "count_matches_expected",
+		Type:      "gauge",
+		Help:      "Whether the gateway reports the expected number of Powerwalls; absent if no expectation is configured",
+		Collector: "powerwalls",
+	})
+)
+
+func queryPowerwalls(ctx context.Context, host string) (*Powerwalls, error) {
+	powerwalls := &Powerwalls{}
+	if err := queryAPI(ctx, host, "/api/powerwalls", powerwalls); err != nil {
+		return nil, err
+	}
+	return powerwalls, nil
+}
+
+// expectedPowerwallsFor returns how many Powerwalls host should report, or
+// 0 if nothing is expected.
+func expectedPowerwallsFor(host string) int {
+	if t := targetConfig(host); t != nil && t.ExpectedPowerwalls > 0 {
+		return t.ExpectedPowerwalls
+	}
+	return *expectedPowerwalls
+}
+
+// collectPowerwalls reports how many Powerwalls the gateway can see. In a
+// multi-unit install the others keep the site running when one drops out,
+// so comparing against the expected count is the only sign of it.
+func collectPowerwalls(ctx context.Context, host string, reg *prometheus.Registry) error {
+	powerwalls, err := queryPowerwalls(ctx, host)
+	if err != nil {
+		return err
+	}
+	actual := len(powerwalls.Powerwalls)
+
+	count, err := countMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	count.Set(float64(actual))
+
+	expected := expectedPowerwallsFor(host)
+	if expected == 0 {
+		return nil
+	}
+
+	expectedCount, err := countExpectedMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	expectedCount.Set(float64(expected))
+
+	matches, err := countMatchesExpectedMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	matches.Set(boolToFloat(actual == expected))
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var probeErrors = defineMetric(metricDef{
+	Name:   "probe_errors_total",
+	Type:   "counter",
+	Help:   "Number of failed scrapes of each target, by cause: auth, rate_limited, http_status, parse, timeout, connection or other",
+	Labels: []string{"target", "reason"},
+	Path:   "/metrics",
+}).newCounterVec()
+
+func init() {
+	prometheus.MustRegister(probeErrors)
+}
+
+// HTTPStatusError is returned when the gateway answers with a non-2xx
+// status and no error envelope explaining why.
+type HTTPStatusError struct {
+	Code int
+	Path string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s returned HTTP %d %s", e.Path, e.Code, http.StatusText(e.Code))
+}
+
+var (
+	// errUnexpectedContentType marks responses that weren't JSON.
+	errUnexpectedContentType = errors.New("unexpected content type")
+	// errRateLimited marks requests the gateway refused with 429.
+	errRateLimited = errors.New("rate limited by Powerwall API")
+	// errTransport marks failures to send a request or read its response.
+	errTransport = errors.New("transport error")
+	// errParse marks responses that couldn't be decoded.
+	errParse = errors.New("malformed response")
+)
+
+// classifiedError tags err as a kind of failure, one of the sentinels
+// above, so errorReason can tell what went wrong with errors.Is instead of
+// guessing from the cause's type or message. The cause stays reachable
+// through Unwrap.
+type classifiedError struct {
+	kind error
+	err  error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+func (e *classifiedError) Is(target error) bool {
+	return target == e.kind
+}
+
+// truncatedMessage explains a response cut short, which gateways do when
+// they close connections while rebooting.
+const truncatedMessage = "response truncated, the gateway closed the connection mid-response"
+
+// isTruncatedJSON reports whether err, from decoding body, means body
+// ended before the JSON did. A gateway that closes a connection without a
+// Content-Length mid-response leaves a body that reads cleanly but is cut
+// short, which is a transport failure rather than malformed data. A syntax
+// error at the very end of body is either that or a bad last byte; a
+// json.Decoder tells them apart by returning io.ErrUnexpectedEOF only for
+// the first.
+func isTruncatedJSON(body []byte, err error) bool {
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) || syntaxErr.Offset != int64(len(body)) {
+		return false
+	}
+	var v json.RawMessage
+	return errors.Is(json.NewDecoder(bytes.NewReader(body)).Decode(&v), io.ErrUnexpectedEOF)
+}
+
+// classify marks err as a failure of the given kind.
+func classify(kind error, err error) error {
+	return &classifiedError{kind: kind, err: err}
+}
+
+// isAuthStatus reports whether an HTTP status code means the gateway
+// rejected our credentials.
+func isAuthStatus(code int) bool {
+	return code == http.StatusUnauthorized || code == http.StatusForbidden
+}
+
+// errorReason classifies a scrape error for probe_errors_total, so alerts
+// can tell problems that need a human (auth) from ones that usually fix
+// themselves (timeouts).
+func errorReason(err error) string {
+	var apiErr *APIError
+	var statusErr *HTTPStatusError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var netErr net.Error
+	var urlErr *url.Error
+
+	switch {
+	case errors.As(err, &apiErr) && isAuthStatus(apiErr.Code),
+		errors.As(err, &statusErr) && isAuthStatus(statusErr.Code):
+		return "auth"
+	case errors.Is(err, errRateLimited):
+		return "rate_limited"
+	case errors.As(err, &statusErr), errors.As(err, &apiErr):
+		return "http_status"
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, context.Canceled),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	// Checked before parse errors: a truncated response fails to decode,
+	// but it's the connection that failed, not the data.
+	case errors.Is(err, errTransport),
+		errors.As(err, &urlErr):
+		return "connection"
+	case errors.Is(err, errParse),
+		errors.Is(err, errUnexpectedContentType),
+		errors.As(err, &syntaxErr),
+		errors.As(err, &typeErr):
+		return "parse"
+	default:
+		return "other"
+	}
+}
+
+// countProbeError records a failed scrape of target.
+func countProbeError(target string, err error) {
+	probeErrors.WithLabelValues(target, errorReason(err)).Inc()
+}
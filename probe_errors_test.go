@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestErrorReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"transport", errTransport, "connection"},
+		{"parse", errParse, "parse"},
+		{"rate limited", errRateLimited, "rate_limited"},
+		{"unexpected content type", errUnexpectedContentType, "parse"},
+		{"API error 401", &APIError{Code: http.StatusUnauthorized, Err: "bad credentials"}, "auth"},
+		{"API error 403", &APIError{Code: http.StatusForbidden, Err: "forbidden"}, "auth"},
+		{"HTTP 401", &HTTPStatusError{Code: http.StatusUnauthorized, Path: "/api/meters/aggregates"}, "auth"},
+		{"HTTP 403", &HTTPStatusError{Code: http.StatusForbidden, Path: "/api/meters/aggregates"}, "auth"},
+		{"API error 404", &APIError{Code: http.StatusNotFound, Err: "Not Found"}, "http_status"},
+		{"HTTP 502", &HTTPStatusError{Code: http.StatusBadGateway, Path: "/api/meters/aggregates"}, "http_status"},
+		{"deadline", context.DeadlineExceeded, "timeout"},
+		{"cancelled", context.Canceled, "timeout"},
+		{"other", errors.New("something else"), "other"},
+	}
+
+	for _, tt := range tests {
+		if got := errorReason(tt.err); got != tt.want {
+			t.Errorf("%s: errorReason(%v) = %q, want %q", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestErrorReasonClassified(t *testing.T) {
+	syntaxErr := &json.SyntaxError{Offset: 3}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"wrapped transport", errors.Wrap(classify(errTransport, io.EOF), "reading http response"), "connection"},
+		{"wrapped with %w", fmt.Errorf("querying: %w", classify(errParse, errors.New("bad data"))), "parse"},
+		{"twice wrapped parse", errors.Wrap(errors.Wrap(classify(errParse, &json.UnmarshalTypeError{Value: "string"}), "parsing"), "querying"), "parse"},
+		{"kind beats cause", classify(errTransport, syntaxErr), "connection"},
+		{"timeout beats transport", classify(errTransport, context.DeadlineExceeded), "timeout"},
+		{"wrapped API error", errors.Wrapf(&APIError{Code: http.StatusUnauthorized, Err: "bad credentials"}, "querying %s", "/api/operation"), "auth"},
+		{"wrapped rate limit", errors.Wrapf(errRateLimited, "retry after %s", "30s"), "rate_limited"},
+		{"unclassified cause", io.EOF, "other"},
+		{"unclassified syntax error", syntaxErr, "parse"},
+	}
+
+	for _, tt := range tests {
+		if got := errorReason(tt.err); got != tt.want {
+			t.Errorf("%s: errorReason(%v) = %q, want %q", tt.name, tt.err, got, tt.want)
+		}
+	}
+
+	err := classify(errTransport, io.EOF)
+	if !errors.Is(err, io.EOF) {
+		t.Error("classified error hides its cause")
+	}
+	if errors.Is(err, errParse) {
+		t.Error("transport error also matches errParse")
+	}
+}
+
+func TestErrorReasonFromGateway(t *testing.T) {
+	gw := newMockGateway(t, "")
+	gw.set("/api/system_status/soe", mockResponse{contentType: "application/json", body: `{"percentage": "full"}`})
+	gw.set("/api/system_status/grid_status", mockResponse{contentType: "application/json", body: `{"grid_status": SystemGridConnected}`})
+
+	for path, want := range map[string]string{
+		"/api/system_status/soe":         "parse",
+		"/api/system_status/grid_status": "parse",
+		"/api/meters/aggregates":         "http_status",
+	} {
+		err := queryAPI(context.Background(), gw.target(), path, &struct {
+			Percentage float64 `json:"percentage"`
+		}{})
+		if got := errorReason(err); got != want {
+			t.Errorf("%s: errorReason(%v) = %q, want %q", path, err, got, want)
+		}
+	}
+
+	target := gw.target()
+	gw.Close()
+	_, err := queryStateOfEnergy(context.Background(), target)
+	if got := errorReason(err); got != "connection" {
+		t.Errorf("stopped gateway: errorReason(%v) = %q, want connection", err, got)
+	}
+}
+
+// TestTruncatedResponse checks that a response cut short by the gateway
+// counts as a connection failure, not malformed data, while a complete but
+// malformed response is still a parse error.
+func TestTruncatedResponse(t *testing.T) {
+	const body = `{"percentage": 81.38916`
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		kind    error
+		reason  string
+	}{
+		{
+			name: "short of Content-Length",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Length", "100")
+				w.Write([]byte(body))
+			},
+			kind:   errTransport,
+			reason: "connection",
+		},
+		{
+			name: "closed without Content-Length",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Connection", "close")
+				w.Write([]byte(body))
+			},
+			kind:   errTransport,
+			reason: "connection",
+		},
+		{
+			name: "complete but malformed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"percentage": 81.38916,}`))
+			},
+			kind:   errParse,
+			reason: "parse",
+		},
+	}
+
+	for _, tt := range tests {
+		gw := newMockGateway(t, "")
+		gw.set("/api/system_status/soe", mockResponse{handler: tt.handler})
+
+		_, err := queryStateOfEnergy(context.Background(), gw.target())
+		if !errors.Is(err, tt.kind) {
+			t.Errorf("%s: error %v is not %v", tt.name, err, tt.kind)
+		}
+		if tt.kind == errTransport && errors.Is(err, errParse) {
+			t.Errorf("%s: truncated response classified as malformed: %v", tt.name, err)
+		}
+		if got := errorReason(err); got != tt.reason {
+			t.Errorf("%s: errorReason(%v) = %q, want %q", tt.name, err, got, tt.reason)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+var (
+	pushGateway = flag.String("push.gateway", "", "URL of a Prometheus Pushgateway. When set, each of -scrape.targets or the -config.file targets is scraped once, the results are pushed there, and the exporter exits instead of serving.")
+	pushJob     = flag.String("push.job", "powerwall", "Job label for metrics pushed with -push.gateway.")
+	pushTimeout = flag.Duration("push.timeout", 30*time.Second, "Timeout for scraping and pushing each target with -push.gateway.")
+)
+
+// runPush scrapes every target once, pushes the results to -push.gateway
+// and exits, nonzero if any target couldn't be scraped or pushed. It suits
+// running from cron where a long-lived exporter is awkward.
+func runPush(targets []string) {
+	failed := 0
+	for _, target := range targets {
+		if err := pushTarget(target); err != nil {
+			slog.Error("Pushing metrics failed", "target", target, "error", err)
+			failed++
+			continue
+		}
+		slog.Info("Pushed metrics", "target", target, "gateway", *pushGateway)
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// pushTarget scrapes target and replaces its group on the Pushgateway with
+// the result. Each target is its own group, keyed by instance, so pushes
+// for one target never remove another's metrics.
+func pushTarget(target string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *pushTimeout)
+	defer cancel()
+
+	g, err := collectTarget(ctx, target, true, nil)
+	if err != nil {
+		return errors.Wrap(err, "scraping")
+	}
+
+	pusher := push.New(*pushGateway, *pushJob).
+		Grouping("instance", target).
+		Gatherer(g)
+	return errors.Wrap(pusher.Push(), "pushing")
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	minRequestInterval = flag.Duration("api.min-request-interval", 0, "Minimum time between requests to the same gateway, so the exporter stays under its rate limit. 0 disables spacing.")
+	maxRetryWait       = flag.Duration("api.max-retry-wait", 10*time.Second, "Longest Retry-After the exporter will wait out when a gateway responds 429 before failing the scrape.")
+	probeRateWarn      = flag.Float64("probe.rate-warn", 0, "Warn when probes for a single target arrive faster than this many per minute, which usually means more than one Prometheus is scraping it. 0 disables the check.")
+)
+
+// probeRateWindow is how far back probes are counted for -probe.rate-warn.
+const probeRateWindow = time.Minute
+
+// rateLimitRetries is how many times a rate-limited request is retried.
+const rateLimitRetries = 2
+
+var rateLimited = defineMetric(metricDef{
+	Name: "rate_limited_total",
+	Type: "counter",
+	Help: "Number of gateway API requests rejected with 429 Too Many Requests",
+	Path: "/metrics",
+}).newCounter()
+
+var retries = defineMetric(metricDef{
+	Name:   "retries_total",
+	Type:   "counter",
+	Help:   "Number of gateway API requests retried after a 429 Too Many Requests, by endpoint",
+	Labels: []string{"endpoint"},
+	Path:   "/metrics",
+}).newCounterVec()
+
+var circuitStateMetric = defineMetric(metricDef{
+	Name:   "circuit_state",
+	Type:   "gauge",
+	Help:   "Whether requests to the target are being failed fast while it asks the exporter to back off: 0 closed, 1 open, 2 half-open until the next request gets through",
+	Labels: []string{"target"},
+	Path:   "/metrics",
+})
+
+var probeRateHigh = defineMetric(metricDef{
+	Name:     "probe_rate_high",
+	Type:     "gauge",
+	Help:     "Whether probes for the target arrived faster than -probe.rate-warn over the last minute",
+	Labels:   []string{"target"},
+	Path:     "/metrics",
+	Requires: "-probe.rate-warn",
+}).newGaugeVec()
+
+func init() {
+	prometheus.MustRegister(rateLimited)
+	prometheus.MustRegister(retries)
+	prometheus.MustRegister(probeRateHigh)
+	prometheus.MustRegister(circuitCollector{})
+}
+
+// Circuit states reported by tesla_powerwall_circuit_state.
+const (
+	circuitClosed   = 0
+	circuitOpen     = 1
+	circuitHalfOpen = 2
+)
+
+// hostLimiter spaces out requests to a single gateway and holds them back
+// while the gateway has asked us to.
+type hostLimiter struct {
+	mu   sync.Mutex
+	next time.Time
+
+	// tripped is set when the gateway asks for a longer back-off than
+	// -api.max-retry-wait, so requests fail fast until openUntil, and
+	// cleared by the next response that isn't a 429. Between the two the
+	// circuit is half-open.
+	tripped   bool
+	openUntil time.Time
+
+	// probes holds when each probe of the host in the last
+	// probeRateWindow arrived, for -probe.rate-warn.
+	probes   []time.Time
+	rateHigh bool
+}
+
+var (
+	limitersMu sync.Mutex
+	limiters   = map[string]*hostLimiter{}
+)
+
+// limiterFor returns the limiter for host, creating it on first use.
+func limiterFor(host string) *hostLimiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	l, ok := limiters[host]
+	if !ok {
+		l = &hostLimiter{}
+		limiters[host] = l
+	}
+	return l
+}
+
+// wait blocks until a request to the host may be sent, or ctx is done.
+func (l *hostLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	if delay := start.Sub(now); delay > *maxRetryWait && delay > *minRequestInterval {
+		// The gateway asked us to back off for longer than we're willing to
+		// wait; fail now rather than tying up the scrape.
+		l.mu.Unlock()
+		return errors.Wrapf(errRateLimited, "backing off for another %s", delay.Round(time.Second))
+	}
+	l.next = start.Add(*minRequestInterval)
+	l.mu.Unlock()
+
+	delay := start.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "waiting to send request to Powerwall API")
+	}
+}
+
+// backoff holds back further requests to the host until the given time.
+// A back-off too long to wait out trips the circuit; backoff reports
+// whether this call tripped it.
+func (l *hostLimiter) backoff(now time.Time, until time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until.After(l.next) {
+		l.next = until
+	}
+	if until.Sub(now) <= *maxRetryWait {
+		return false
+	}
+	if until.After(l.openUntil) {
+		l.openUntil = until
+	}
+	wasTripped := l.tripped
+	l.tripped = true
+	return !wasTripped
+}
+
+// succeeded closes the circuit after a response that wasn't a 429.
+func (l *hostLimiter) succeeded() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tripped = false
+}
+
+// reset closes the circuit and drops any back-off the gateway asked for, so
+// the next request is sent straight away. It reports whether the circuit
+// was tripped.
+func (l *hostLimiter) reset(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	wasTripped := l.tripped
+	l.tripped = false
+	l.openUntil = time.Time{}
+	if l.next.After(now) {
+		l.next = now
+	}
+	return wasTripped
+}
+
+// circuitState returns the host's circuit state at now.
+func (l *hostLimiter) circuitState(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case !l.tripped:
+		return circuitClosed
+	case now.Before(l.openUntil):
+		return circuitOpen
+	default:
+		return circuitHalfOpen
+	}
+}
+
+// circuitCollector reports each gateway's circuit state when /metrics is
+// scraped, so an open circuit turns half-open on time without anything
+// having to update it.
+type circuitCollector struct{}
+
+func (circuitCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- circuitStateMetric.desc()
+}
+
+func (circuitCollector) Collect(ch chan<- prometheus.Metric) {
+	limitersMu.Lock()
+	hosts := make(map[string]*hostLimiter, len(limiters))
+	for host, l := range limiters {
+		hosts[host] = l
+	}
+	limitersMu.Unlock()
+
+	now := time.Now()
+	for host, l := range hosts {
+		ch <- prometheus.MustNewConstMetric(circuitStateMetric.desc(), prometheus.GaugeValue, float64(l.circuitState(now)), host)
+	}
+}
+
+// observeProbe records a probe of host arriving at now, and flags the host
+// once probes arrive faster than -probe.rate-warn. The warning is logged
+// when the rate first goes over, not on every probe.
+func observeProbe(host string, now time.Time) {
+	if *probeRateWarn <= 0 {
+		return
+	}
+	l := limiterFor(host)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := now.Add(-probeRateWindow)
+	kept := l.probes[:0]
+	for _, t := range l.probes {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	l.probes = append(kept, now)
+
+	perMinute := float64(len(l.probes)) / probeRateWindow.Minutes()
+	high := perMinute > *probeRateWarn
+	if high && !l.rateHigh {
+		slog.Warn("Target is being probed unusually often; check whether more than one Prometheus is scraping it",
+			"target", host, "probes_per_minute", perMinute, "threshold", *probeRateWarn)
+	}
+	l.rateHigh = high
+	probeRateHigh.WithLabelValues(host).Set(boolToFloat(high))
+}
+
+// retryAfter parses a Retry-After header, given either in seconds or as an
+// HTTP date. It defaults to one second if the header is missing or invalid.
+func retryAfter(header string, now time.Time) time.Duration {
+	if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return time.Second
+}
+
+// doRateLimited sends req to host, respecting -api.min-request-interval and
+// retrying while the gateway responds 429 if its Retry-After can be waited
+// out within -api.max-retry-wait and ctx's deadline.
+func doRateLimited(ctx context.Context, host string, req *http.Request) (*http.Response, error) {
+	limiter := limiterFor(host)
+
+	for attempt := 0; ; attempt++ {
+		if err := limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+		resp, err := httpClient.Do(req)
+		countAPIRequest(ctx, apiEndpoint(req.URL.Path), resp, err, time.Since(start))
+		if err != nil {
+			return resp, err
+		}
+		if resp.StatusCode != http.StatusTooManyRequests {
+			limiter.succeeded()
+			return resp, err
+		}
+		resp.Body.Close()
+		rateLimited.Inc()
+
+		now := time.Now()
+		delay := retryAfter(resp.Header.Get("Retry-After"), now)
+		if limiter.backoff(now, now.Add(delay)) {
+			slog.WarnContext(ctx, "Gateway asked for a long back-off, failing its requests fast until it ends", "target", host, "until", now.Add(delay))
+		}
+
+		if attempt >= rateLimitRetries || delay > *maxRetryWait {
+			return nil, errors.Wrapf(errRateLimited, "retry after %s", delay)
+		}
+		if deadline, ok := ctx.Deadline(); ok && now.Add(delay).After(deadline) {
+			return nil, errors.Wrapf(errRateLimited, "retry after %s exceeds the scrape deadline", delay)
+		}
+		retries.WithLabelValues(apiEndpoint(req.URL.Path)).Inc()
+	}
+}
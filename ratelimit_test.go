@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestCircuitState(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := &hostLimiter{}
+
+	steps := []struct {
+		name    string
+		step    func() bool
+		tripped bool
+		at      time.Time
+		want    int
+	}{
+		{"new", nil, false, now, circuitClosed},
+		{"short back-off", func() bool { return l.backoff(now, now.Add(*maxRetryWait)) }, false, now, circuitClosed},
+		{"long back-off", func() bool { return l.backoff(now, now.Add(time.Minute)) }, true, now, circuitOpen},
+		{"longer back-off while open", func() bool { return l.backoff(now, now.Add(2*time.Minute)) }, false, now.Add(90 * time.Second), circuitOpen},
+		{"back-off over", nil, false, now.Add(2 * time.Minute), circuitHalfOpen},
+		{"request got through", func() bool { l.succeeded(); return false }, false, now.Add(2 * time.Minute), circuitClosed},
+		{"tripped again", func() bool { return l.backoff(now, now.Add(time.Hour)) }, true, now, circuitOpen},
+		{"reset", func() bool { return l.reset(now) }, true, now, circuitClosed},
+		{"reset when closed", func() bool { return l.reset(now) }, false, now, circuitClosed},
+	}
+
+	for _, s := range steps {
+		if s.step != nil {
+			if got := s.step(); got != s.tripped {
+				t.Errorf("%s: reported %v, want %v", s.name, got, s.tripped)
+			}
+		}
+		if got := l.circuitState(s.at); got != s.want {
+			t.Errorf("%s: circuitState() = %d, want %d", s.name, got, s.want)
+		}
+	}
+}
+
+func TestCircuitOpensOnLongRetryAfter(t *testing.T) {
+	const path = "/api/system_status/soe"
+	gw := newMockGateway(t, "23.44.0")
+	gw.set(path, mockResponse{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}})
+
+	_, err := queryStateOfEnergy(context.Background(), gw.target())
+	if !errors.Is(err, errRateLimited) {
+		t.Fatalf("error %v is not %v", err, errRateLimited)
+	}
+	l := limiterFor(gw.target())
+	if got := l.circuitState(time.Now()); got != circuitOpen {
+		t.Fatalf("circuitState() = %d after Retry-After: 3600, want %d", got, circuitOpen)
+	}
+
+	// While open, requests fail without reaching the gateway.
+	before := gw.requested(path)
+	if _, err := queryStateOfEnergy(context.Background(), gw.target()); !errors.Is(err, errRateLimited) {
+		t.Errorf("error %v with the circuit open is not %v", err, errRateLimited)
+	}
+	if n := gw.requested(path) - before; n != 0 {
+		t.Errorf("gateway received %d requests with the circuit open, want 0", n)
+	}
+
+	// Once reset, the next request goes through and closes it.
+	gw.set(path, loadFirmware(t, "23.44.0")[path])
+	l.reset(time.Now())
+	if _, err := queryStateOfEnergy(context.Background(), gw.target()); err != nil {
+		t.Fatalf("query after reset failed: %v", err)
+	}
+	if got := l.circuitState(time.Now()); got != circuitClosed {
+		t.Errorf("circuitState() = %d after a successful request, want %d", got, circuitClosed)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Registration is the response from /api/customer/registration.
+type Registration struct {
+	Registered           bool `json:"registered"`
+	TimedOutRegistration bool `json:"timed_out_registration"`
+}
+
+var registeredMetric = defineMetric(metricDef{
+	Name:      "registered",
+	Type:      "gauge",
+	Help:      "Whether the gateway is registered to an owner; a gateway that was reset and not re-registered behaves oddly",
+	Collector: "registration",
+})
+
+func queryRegistration(ctx context.Context, host string) (*Registration, error) {
+	registration := &Registration{}
+	if err := queryAPI(ctx, host, "/api/customer/registration", registration); err != nil {
+		return nil, err
+	}
+	return registration, nil
+}
+
+func collectRegistration(ctx context.Context, host string, reg *prometheus.Registry) error {
+	registration, err := queryRegistration(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	registered, err := registeredMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	registered.Set(boolToFloat(registration.Registered))
+
+	return nil
+}
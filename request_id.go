@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"log/slog"
+)
+
+// requestIDHeader is the response header a probe's request ID is returned
+// in, so a slow or failed scrape can be matched to its log lines.
+const requestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// newRequestID returns a short random ID, 11 URL-safe characters.
+func newRequestID() string {
+	var b [8]byte
+	// crypto/rand only fails if the OS has no entropy source, and an
+	// all-zero ID is still usable.
+	rand.Read(b[:])
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+// withRequestID returns a copy of ctx carrying id.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFrom returns the request ID carried by ctx, or "".
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDHandler adds the request ID carried by a record's context to
+// it, so everything logged with the *Context functions during a probe or
+// background scrape can be found by that ID.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	scrapeTargets  = flag.String("scrape.targets", "", "Comma separated list of gateways to scrape in the background. Probes for these targets are answered from the latest background scrape.")
+	scrapeInterval = flag.Duration("scrape.interval", 30*time.Second, "How often each of -scrape.targets is scraped.")
+
+	scrapeSlowInterval   = flag.Duration("scrape.slow-interval", 0, "How often to query slow-changing endpoints (registration, solars, system_status, powerwalls, battery_blocks); scrapes in between reuse their last result. 0 queries them on every scrape.")
+	scrapeMaxConcurrency = flag.Int("scrape.max-concurrency", 0, "Maximum number of targets queried at once, across probes and background scrapes. Further scrapes wait for a free slot. 0 means unlimited.")
+)
+
+// scrapeSlots bounds concurrent scrapes, or is nil when unlimited.
+var scrapeSlots chan struct{}
+
+var scrapesInFlight = defineMetric(metricDef{
+	Name: "scrapes_in_flight",
+	Type: "gauge",
+	Help: "Number of targets currently being queried",
+	Path: "/metrics",
+}).newGauge()
+
+func init() {
+	prometheus.MustRegister(scrapesInFlight)
+}
+
+// acquireScrapeSlot blocks until a target may be queried under
+// -scrape.max-concurrency, and returns a function releasing the slot. It
+// gives up if ctx is done first.
+func acquireScrapeSlot(ctx context.Context) (func(), error) {
+	if scrapeSlots != nil {
+		select {
+		case scrapeSlots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "waiting for a free scrape slot")
+		}
+	}
+	scrapesInFlight.Inc()
+
+	return func() {
+		scrapesInFlight.Dec()
+		if scrapeSlots != nil {
+			<-scrapeSlots
+		}
+	}, nil
+}
+
+// scraper is the background scraper, or nil when background scraping is not
+// configured.
+var scraper *backgroundScraper
+
+// scrapeResult is the outcome of a single background scrape of a target.
+type scrapeResult struct {
+	reg  prometheus.Gatherer
+	err  error
+	time time.Time
+
+	// lastGood and lastGoodTime are the most recent successful scrape,
+	// which is this one unless it failed.
+	lastGood     prometheus.Gatherer
+	lastGoodTime time.Time
+}
+
+// backgroundScraper collects a set of targets on a timer, so per-target
+// state is fed at a steady rate however often Prometheus scrapes us.
+type backgroundScraper struct {
+	interval time.Duration
+
+	mu      sync.RWMutex
+	targets map[string]context.CancelFunc
+	results map[string]*scrapeResult
+}
+
+func newBackgroundScraper(interval time.Duration) *backgroundScraper {
+	return &backgroundScraper{
+		interval: interval,
+		targets:  map[string]context.CancelFunc{},
+		results:  map[string]*scrapeResult{},
+	}
+}
+
+// parseTargets splits a comma separated list of targets, dropping blanks.
+func parseTargets(list string) []string {
+	var targets []string
+	for _, target := range strings.Split(list, ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			targets = append(targets, normalizeTarget(target))
+		}
+	}
+	return targets
+}
+
+// setTargets starts a scrape loop for every new target and stops the loops
+// of targets no longer listed.
+func (s *backgroundScraper) setTargets(targets []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := map[string]bool{}
+	for _, target := range targets {
+		wanted[target] = true
+		if _, ok := s.targets[target]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		s.targets[target] = cancel
+		go s.run(ctx, target)
+	}
+
+	for target, cancel := range s.targets {
+		if !wanted[target] {
+			cancel()
+			delete(s.targets, target)
+			delete(s.results, target)
+		}
+	}
+}
+
+func (s *backgroundScraper) run(ctx context.Context, target string) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.scrape(ctx, target)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *backgroundScraper) scrape(ctx context.Context, target string) {
+	ctx = withRequestID(ctx, newRequestID())
+	now := time.Now()
+	reg, err := collectTarget(ctx, target, false, nil)
+	if ctx.Err() != nil {
+		// The target was removed while we were scraping it.
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Background scrape failed", "target", target, "error", err)
+		countProbeError(target, err)
+	}
+
+	if err == nil && (graphite != nil || broker != nil) {
+		families, gatherErr := reg.Gather()
+		if gatherErr != nil {
+			slog.Error("Gathering metrics for push failed", "target", target, "error", gatherErr)
+		} else {
+			if graphite != nil {
+				graphite.write(target, families, now)
+			}
+			if broker != nil {
+				broker.publish(newStreamEvent(target, now, families))
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.targets[target]; !ok {
+		return
+	}
+	result := &scrapeResult{reg: reg, err: err, time: now}
+	if err == nil {
+		result.lastGood, result.lastGoodTime = reg, now
+	} else if prev := s.results[target]; prev != nil {
+		result.lastGood, result.lastGoodTime = prev.lastGood, prev.lastGoodTime
+	}
+	s.results[target] = result
+}
+
+// dropHeld forgets the last good result of every target whose latest
+// scrape failed, so -metrics.hold-last stops serving it. It returns how
+// many were dropped.
+func (s *backgroundScraper) dropHeld() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dropped := 0
+	for target, result := range s.results {
+		if result.err == nil || result.lastGood == nil {
+			continue
+		}
+		// Results are shared with probes being served, so replace rather
+		// than modify them.
+		s.results[target] = &scrapeResult{reg: result.reg, err: result.err, time: result.time}
+		dropped++
+	}
+	return dropped
+}
+
+// handles reports whether target is scraped in the background.
+func (s *backgroundScraper) handles(target string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.targets[target]
+	return ok
+}
+
+// errNoBackgroundResult means no background scrape of a target has
+// completed yet.
+var errNoBackgroundResult = errors.New("no background scrape has completed for this target yet")
+
+// gatherer returns what should be served for target from its latest
+// background scrape.
+func (s *backgroundScraper) gatherer(target string) (prometheus.Gatherer, error) {
+	s.mu.RLock()
+	result := s.results[target]
+	s.mu.RUnlock()
+
+	if result == nil {
+		return nil, errNoBackgroundResult
+	}
+
+	var reg prometheus.Gatherer
+	if result.err == nil {
+		reg = prometheus.Gatherers{result.reg, upGatherer(1)}
+	}
+	if *holdLast > 0 {
+		held, err := heldResult(result, time.Now())
+		if err != nil {
+			slog.Error("Building held result failed", "target", target, "error", err)
+		} else if held != nil {
+			reg = held
+		}
+	}
+	if reg == nil {
+		return nil, result.err
+	}
+	if *powerWindowEnabled {
+		window, err := takePowerWindow(target)
+		if err != nil {
+			return nil, err
+		}
+		reg = prometheus.Gatherers{reg, window}
+	}
+	return reg, nil
+}
+
+// serve answers a probe for target from its latest background scrape.
+func (s *backgroundScraper) serve(target string, w http.ResponseWriter, r *http.Request) {
+	reg, err := s.gatherer(target)
+	if err == errNoBackgroundResult {
+		failProbe(w, r, http.StatusServiceUnavailable, "No background scrape has completed for this target yet.")
+		return
+	}
+	if err != nil {
+		failProbe(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	h := promhttp.HandlerFor(reg, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	})
+	h.ServeHTTP(w, r)
+}
+
+// cachedCollection is the last result of a slow collector for a target.
+type cachedCollection struct {
+	reg  prometheus.Gatherer
+	time time.Time
+}
+
+// cachedResult returns the last result of c for target if it is a slow
+// collector whose result is still within -scrape.slow-interval, or nil.
+func cachedResult(target string, c *collector) prometheus.Gatherer {
+	if !c.slow || *scrapeSlowInterval <= 0 {
+		return nil
+	}
+
+	state := stateFor(target)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	cached, ok := state.slowCollections[c.name]
+	if !ok || time.Since(cached.time) >= *scrapeSlowInterval {
+		return nil
+	}
+	return cached.reg
+}
+
+// cacheResult remembers the result of c for target if it is a slow
+// collector.
+func cacheResult(target string, c *collector, reg prometheus.Gatherer) {
+	if !c.slow || *scrapeSlowInterval <= 0 {
+		return
+	}
+
+	state := stateFor(target)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.slowCollections == nil {
+		state.slowCollections = map[string]cachedCollection{}
+	}
+	state.slowCollections[c.name] = cachedCollection{reg: reg, time: time.Now()}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// selfCollector reports the size of the exporter's in-memory bookkeeping,
+// read when /metrics is scraped so it costs nothing in between.
+type selfCollector struct{}
+
+var (
+	trackedTargetsMetric = defineMetric(metricDef{
+		Name: "tracked_targets",
+		Type: "gauge",
+		Help: "Number of targets the exporter holds per-target state for",
+		Path: "/metrics",
+	})
+	enabledCollectorsMetric = defineMetric(metricDef{
+		Name: "enabled_collectors",
+		Type: "gauge",
+		Help: "Number of collectors run against each target on every scrape",
+		Path: "/metrics",
+	})
+	cachedCollectionsMetric = defineMetric(metricDef{
+		Name: "cached_collections",
+		Type: "gauge",
+		Help: "Number of slow collector results cached across all targets for -scrape.slow-interval",
+		Path: "/metrics",
+	})
+	backgroundWorkersMetric = defineMetric(metricDef{
+		Name: "background_scrape_workers",
+		Type: "gauge",
+		Help: "Number of targets being scraped in the background, each by its own worker",
+		Path: "/metrics",
+	})
+	backgroundResultsMetric = defineMetric(metricDef{
+		Name: "background_scrape_results",
+		Type: "gauge",
+		Help: "Number of background scrape results held in memory",
+		Path: "/metrics",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(selfCollector{})
+}
+
+func (selfCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- trackedTargetsMetric.desc()
+	ch <- enabledCollectorsMetric.desc()
+	ch <- cachedCollectionsMetric.desc()
+	ch <- backgroundWorkersMetric.desc()
+	ch <- backgroundResultsMetric.desc()
+}
+
+func (selfCollector) Collect(ch chan<- prometheus.Metric) {
+	statesMu.Lock()
+	targetStates := make([]*targetState, 0, len(states))
+	for _, s := range states {
+		targetStates = append(targetStates, s)
+	}
+	statesMu.Unlock()
+
+	cached := 0
+	for _, s := range targetStates {
+		s.mu.Lock()
+		cached += len(s.slowCollections)
+		s.mu.Unlock()
+	}
+
+	ch <- prometheus.MustNewConstMetric(trackedTargetsMetric.desc(), prometheus.GaugeValue, float64(len(targetStates)))
+	ch <- prometheus.MustNewConstMetric(enabledCollectorsMetric.desc(), prometheus.GaugeValue, float64(len(enabledCollectors())))
+	ch <- prometheus.MustNewConstMetric(cachedCollectionsMetric.desc(), prometheus.GaugeValue, float64(cached))
+
+	var workers, results int
+	if scraper != nil {
+		scraper.mu.RLock()
+		workers, results = len(scraper.targets), len(scraper.results)
+		scraper.mu.RUnlock()
+	}
+	ch <- prometheus.MustNewConstMetric(backgroundWorkersMetric.desc(), prometheus.GaugeValue, float64(workers))
+	ch <- prometheus.MustNewConstMetric(backgroundResultsMetric.desc(), prometheus.GaugeValue, float64(results))
+}
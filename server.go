@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	listenAddress      = flag.String("web.listen-address", "0.0.0.0:8080", "Address to serve /probe, /metrics and /metrics/list on. Empty disables TCP, for use with -web.unix-socket.")
+	probeListenAddress = flag.String("web.probe-listen-address", "", "If set, serve /probe on this address instead, leaving /metrics and /metrics/list on -web.listen-address.")
+	telemetryPath      = flag.String("web.telemetry-path", "/metrics", "Path to serve the exporter's own metrics on. The metric catalog is served at this path plus /list.")
+	probePath          = flag.String("web.probe-path", "/probe", "Path to serve gateway probes on.")
+	shutdownTimeout    = flag.Duration("web.shutdown-timeout", 10*time.Second, "How long to wait for in-flight requests to finish on SIGINT or SIGTERM.")
+	unixSocket         = flag.String("web.unix-socket", "", "Also serve everything served on -web.listen-address on this Unix domain socket. Set -web.listen-address to an empty string to serve on the socket only.")
+	unixSocketMode     = flag.String("web.unix-socket-mode", "0660", "Permissions of the -web.unix-socket file, in octal.")
+)
+
+// unixAddressPrefix marks a listen address in serve's servers map as a Unix
+// socket path rather than a TCP address.
+const unixAddressPrefix = "unix:"
+
+var probesInFlight = defineMetric(metricDef{
+	Name: "probes_in_flight",
+	Type: "gauge",
+	Help: "Number of probe requests currently being served",
+	Path: "/metrics",
+}).newGauge()
+
+func init() {
+	prometheus.MustRegister(probesInFlight)
+}
+
+// inFlightProbes mirrors probes_in_flight so shutdown can report it.
+var inFlightProbes atomic.Int64
+
+// trackInFlight wraps a probe handler so in-flight probes are counted.
+func trackInFlight(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		inFlightProbes.Add(1)
+		probesInFlight.Inc()
+		defer func() {
+			probesInFlight.Dec()
+			inFlightProbes.Add(-1)
+		}()
+		h(w, r)
+	}
+}
+
+// validatePaths checks -web.telemetry-path and -web.probe-path.
+func validatePaths() error {
+	for flagName, path := range map[string]string{
+		"-web.telemetry-path": *telemetryPath,
+		"-web.probe-path":     *probePath,
+	} {
+		if !strings.HasPrefix(path, "/") || path == "/" {
+			return errors.Errorf("%s must start with / and not be / itself, got %q", flagName, path)
+		}
+	}
+	if *telemetryPath == *probePath || *telemetryPath+"/list" == *probePath {
+		return errors.New("-web.telemetry-path and -web.probe-path must not overlap")
+	}
+	return nil
+}
+
+// listen opens a listener on addr, which is a TCP address or, with
+// unixAddressPrefix, the path of a Unix socket. A socket left behind by a
+// previous run that didn't shut down cleanly is replaced; any other file in
+// the way is an error. The socket is removed again when the listener is
+// closed.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixAddressPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	mode, err := strconv.ParseUint(*unixSocketMode, 8, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing -web.unix-socket-mode")
+	}
+	if mode&^0777 != 0 {
+		return nil, errors.Errorf("-web.unix-socket-mode must only set permission bits, got %s", *unixSocketMode)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, errors.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, errors.Wrap(err, "removing stale socket")
+		}
+	}
+
+	// Changing the mode after the socket exists would leave a window in
+	// which anyone allowed by the process umask could connect, so the
+	// socket is created with the right mode instead. The umask is process
+	// wide, so it is only changed for as long as that takes.
+	umaskMu.Lock()
+	old := syscall.Umask(int(0777 &^ mode))
+	l, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	umaskMu.Unlock()
+	return l, err
+}
+
+// umaskMu serializes changes to the process umask.
+var umaskMu sync.Mutex
+
+// serve runs an HTTP server for each mux in servers, keyed by listen
+// address, until one of them fails or the process is asked to stop. On
+// SIGINT or SIGTERM every server is shut down gracefully together.
+func serve(servers map[string]http.Handler) error {
+	errs := make(chan error, len(servers))
+	var running []*http.Server
+
+	for addr, handler := range servers {
+		l, err := listen(addr)
+		if err != nil {
+			for _, srv := range running {
+				srv.Close()
+			}
+			return errors.Wrapf(err, "listening on %s", addr)
+		}
+
+		srv := &http.Server{Addr: addr, Handler: handler}
+		if broker != nil {
+			// Shutdown waits for responses in progress, which a /stream
+			// never finishes on its own.
+			srv.RegisterOnShutdown(broker.close)
+		}
+		running = append(running, srv)
+
+		go func() {
+			slog.Info("Listening", "address", srv.Addr)
+			if err := srv.Serve(l); err != http.ErrServerClosed {
+				errs <- err
+			}
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	var err error
+	select {
+	case err = <-errs:
+	case sig := <-stop:
+		slog.Info("Shutting down", "signal", sig.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	draining := inFlightProbes.Load()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for _, srv := range running {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if shutdownErr := srv.Shutdown(ctx); shutdownErr != nil {
+				slog.Error("Shutting down listener failed", "address", srv.Addr, "error", shutdownErr)
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	if remaining := inFlightProbes.Load(); remaining > 0 {
+		slog.Warn("Shutdown timed out with probes still in flight", "in_flight", draining, "cut_off", remaining, "duration", time.Since(start).String())
+	} else {
+		slog.Info("Drained in-flight probes", "count", draining, "duration", time.Since(start).String())
+	}
+
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnixSocketMode(t *testing.T) {
+	// A permissive umask would leave the socket open to everyone if its
+	// mode were only set after it was created.
+	old := syscall.Umask(0)
+	t.Cleanup(func() { syscall.Umask(old) })
+
+	for _, tt := range []struct {
+		mode string
+		want os.FileMode
+	}{
+		{"0600", 0600},
+		{"0660", 0660},
+	} {
+		setFlag(t, unixSocketMode, tt.mode)
+		path := filepath.Join(t.TempDir(), "exporter.sock")
+
+		l, err := listen(unixAddressPrefix + path)
+		if err != nil {
+			t.Fatalf("listen failed: %v", err)
+		}
+		info, err := os.Stat(path)
+		l.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != tt.want {
+			t.Errorf("-web.unix-socket-mode %s: socket mode %v, want %v", tt.mode, got, tt.want)
+		}
+	}
+
+	if current := syscall.Umask(0); current != 0 {
+		t.Errorf("umask left at %o after listen", current)
+	}
+
+	setFlag(t, unixSocketMode, "04660")
+	if l, err := listen(unixAddressPrefix + filepath.Join(t.TempDir(), "exporter.sock")); err == nil {
+		l.Close()
+		t.Error("listen accepted a -web.unix-socket-mode with setuid set")
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"flag"
+	"math"
+	"math/big"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	simulate     = flag.Bool("simulate", false, "Run a simulated gateway in-process, reachable as target=simulator, with synthetic but realistic readings. For building dashboards and demos without hardware.")
+	simulateSeed = flag.Int64("simulate.seed", 1, "Seed for the noise in -simulate readings. The same seed and request times give the same readings.")
+)
+
+// simulatorTarget is the target name that reaches the simulated gateway.
+const simulatorTarget = "simulator"
+
+// simulatorAddress is where the simulated gateway listens, or "" when
+// -simulate is off.
+var simulatorAddress string
+
+// The simulated site: a 5kW solar array and one 13.5kWh Powerwall that
+// keeps a 20% backup reserve.
+const (
+	simSolarCapacity = 5000.0
+	simPackEnergy    = 13500.0
+	simMaxPower      = 5000.0
+	simReserve       = 20.0
+)
+
+// simulator models a site well enough for dashboards to look right: solar
+// follows the sun, load peaks in the morning and evening, and the battery
+// soaks up surplus solar and covers the shortfall until it hits its reserve.
+// The grid makes up the rest.
+type simulator struct {
+	mu      sync.Mutex
+	rand    *mathrand.Rand
+	started time.Time
+	last    time.Time
+
+	// remaining is the energy in the battery, in Wh.
+	remaining float64
+	// power is the latest instant power of each source, positive when
+	// importing for site and load and when producing for battery and
+	// solar, as the gateway reports it.
+	power map[string]float64
+	// exported and imported are each source's lifetime energy counters,
+	// in Wh.
+	exported map[string]float64
+	imported map[string]float64
+	voltage  float64
+	freq     float64
+}
+
+func newSimulator(seed int64, now time.Time) *simulator {
+	s := &simulator{
+		rand:      mathrand.New(mathrand.NewSource(seed)),
+		started:   now,
+		last:      now,
+		remaining: simPackEnergy / 2,
+		power:     map[string]float64{},
+		exported:  map[string]float64{"site": 3200000, "battery": 2100000, "load": 0, "solar": 9800000},
+		imported:  map[string]float64{"site": 4500000, "battery": 2400000, "load": 11400000, "solar": 0},
+	}
+	s.step(now)
+	return s
+}
+
+// step advances the model to now, integrating the energy moved since the
+// last step at the power levels now.
+func (s *simulator) step(now time.Time) {
+	hours := now.Sub(s.last).Hours()
+	if hours < 0 {
+		hours = 0
+	}
+	s.last = now
+
+	local := now.In(time.Local)
+	hour := float64(local.Hour()) + float64(local.Minute())/60 + float64(local.Second())/3600
+
+	// Solar is a half sine wave from 6am to 6pm, dimmed by passing cloud.
+	solar := simSolarCapacity * math.Max(0, math.Sin(math.Pi*(hour-6)/12)) * (0.85 + 0.15*s.rand.Float64())
+	// Load is a base plus morning and evening peaks.
+	load := 350 + 1400*math.Exp(-math.Pow(hour-19, 2)/2) + 700*math.Exp(-math.Pow(hour-7.5, 2)/0.5) + 150*s.rand.Float64()
+
+	var battery float64
+	if surplus := solar - load; surplus > 0 {
+		if s.remaining < simPackEnergy {
+			battery = -math.Min(surplus, simMaxPower)
+		}
+	} else if s.remaining > simPackEnergy*simReserve/100 {
+		battery = math.Min(-surplus, simMaxPower)
+	}
+	site := load - solar - battery
+
+	s.power = map[string]float64{"site": site, "battery": battery, "load": load, "solar": solar}
+	for source, p := range s.power {
+		energy := math.Abs(p) * hours
+		// Site and load count import as positive; battery and solar
+		// count production as positive.
+		if (p > 0) == (source == "site" || source == "load") {
+			s.imported[source] += energy
+		} else {
+			s.exported[source] += energy
+		}
+	}
+	s.remaining = math.Max(0, math.Min(simPackEnergy, s.remaining-battery*hours))
+
+	s.voltage = 240 + 3*math.Sin(2*math.Pi*hour/24) + s.rand.NormFloat64()*0.5
+	s.freq = 50 + s.rand.NormFloat64()*0.02
+}
+
+// meters returns the /api/meters/aggregates response.
+func (s *simulator) meters() *PowerwallStatus {
+	record := func(source string) Record {
+		p := s.power[source]
+		return Record{
+			LastCommunicationTime: s.last,
+			InstantPower:          p,
+			InstantApparentPower:  math.Abs(p),
+			Frequency:             s.freq,
+			EnergyExported:        s.exported[source],
+			EnergyImported:        s.imported[source],
+			InstantAverageVoltage: s.voltage,
+			InstantTotalCurrent:   p / s.voltage,
+			Timeout:               1500000000,
+		}
+	}
+	return &PowerwallStatus{
+		Site:    record("site"),
+		Battery: record("battery"),
+		Load:    record("load"),
+		Solar:   record("solar"),
+	}
+}
+
+// systemStatus returns the /api/system_status response.
+func (s *simulator) systemStatus() interface{} {
+	return map[string]interface{}{
+		"nominal_full_pack_energy": simPackEnergy,
+		"nominal_energy_remaining": s.remaining,
+		"available_blocks":         1,
+		"battery_target_power":     s.power["battery"],
+		"max_charge_power":         simMaxPower,
+		"max_discharge_power":      simMaxPower,
+		"battery_blocks": []map[string]interface{}{{
+			"PackageSerialNumber": "SIM00000001",
+			"pinv_state":          "PINV_GridFollowing",
+			"pinv_grid_state":     "Grid_Compliant",
+			"p_out":               s.power["battery"],
+			"q_out":               0,
+		}},
+	}
+}
+
+// responses returns what the simulated gateway serves on each endpoint.
+// Callers must hold s.mu.
+func (s *simulator) responses() map[string]interface{} {
+	return map[string]interface{}{
+		"/api/meters/aggregates":         s.meters(),
+		"/api/system_status/soe":         &StateOfEnergy{Percentage: s.remaining / simPackEnergy * 100},
+		"/api/system_status/grid_status": map[string]interface{}{"grid_status": "SystemGridConnected", "grid_services_active": false},
+		"/api/operation":                 &Operation{RealMode: "self_consumption", BackupReservePercent: simReserve},
+		"/api/sitemaster":                &Sitemaster{Running: true, ConnectedToTesla: true},
+		"/api/system_status":             s.systemStatus(),
+		"/api/status": map[string]interface{}{
+			"din":             "SIMULATED",
+			"version":         "simulated",
+			"device_type":     "teg",
+			"start_time":      s.started.Format("2006-01-02 15:04:05 -0700"),
+			"up_time_seconds": s.last.Sub(s.started).Round(time.Second).String(),
+		},
+		"/api/site_info": map[string]interface{}{
+			"site_name": "Simulated site",
+			"timezone":  time.Local.String(),
+			"grid_code": &GridCode{GridCode: "50Hz_240V_1_SIMULATED", GridVoltageSetting: 240, GridFreqSetting: 50, GridPhaseSetting: "Single"},
+		},
+		"/api/solars":                []*Solar{{Brand: "Simulated", Model: "SIM-5000", PowerRatingWatts: simSolarCapacity}},
+		"/api/powerwalls":            map[string]interface{}{"powerwalls": []map[string]string{{"PackageSerialNumber": "SIM00000001"}}},
+		"/api/customer/registration": &Registration{Registered: true},
+	}
+}
+
+func (s *simulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.step(time.Now())
+	body, ok := s.responses()[r.URL.Path]
+	s.mu.Unlock()
+
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(&APIError{Code: http.StatusNotFound, Err: "Not Found"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// startSimulator serves a simulated gateway over TLS on a loopback port and
+// returns its address.
+func startSimulator(seed int64) (string, error) {
+	cert, err := selfSignedCertificate()
+	if err != nil {
+		return "", errors.Wrap(err, "generating simulator certificate")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", errors.Wrap(err, "listening for simulator")
+	}
+
+	server := &http.Server{Handler: newSimulator(seed, time.Now())}
+	go server.Serve(tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}}))
+
+	return l.Addr().String(), nil
+}
+
+// selfSignedCertificate makes a throwaway certificate for the simulator,
+// self-signed like a real gateway's.
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: simulatorTarget},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{simulatorTarget},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var soeDaily = flag.Bool("metrics.soe-daily", false, "Export the lowest and highest battery state of energy seen since local midnight. Relies on per-target state; use background scraping for accurate values.")
+
+var (
+	soeDailyMinMetric = defineMetric(metricDef{
+		Name:      "soe_daily_min",
+		Type:      "gauge",
+		Unit:      "percent",
+		Help:      "Lowest battery percentage seen by the exporter since local midnight",
+		Collector: "soe",
+		Requires:  "-metrics.soe-daily",
+	})
+	soeDailyMaxMetric = defineMetric(metricDef{
+		Name:      "soe_daily_max",
+		Type:      "gauge",
+		Unit:      "percent",
+		Help:      "Highest battery percentage seen by the exporter since local midnight",
+		Collector: "soe",
+		Requires:  "-metrics.soe-daily",
+	})
+)
+
+// dailyRange tracks the lowest and highest value observed on a local day.
+type dailyRange struct {
+	day      string
+	min, max float64
+}
+
+// observe records value for the given local day, starting afresh when the
+// day changes.
+func (d *dailyRange) observe(day string, value float64) {
+	if d.day != day {
+		d.day = day
+		d.min, d.max = value, value
+		return
+	}
+	if value < d.min {
+		d.min = value
+	}
+	if value > d.max {
+		d.max = value
+	}
+}
+
+// populateSOEDaily exports the day's lowest and highest state of energy,
+// including the current reading.
+func populateSOEDaily(ctx context.Context, host string, percentage float64, reg *prometheus.Registry) error {
+	min, err := soeDailyMinMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	max, err := soeDailyMaxMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+
+	day := time.Now().In(timezone(ctx, host)).Format("2006-01-02")
+
+	state := stateFor(host)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.soeDaily == nil {
+		state.soeDaily = &dailyRange{}
+	}
+
+	state.soeDaily.observe(day, percentage)
+
+	min.Set(state.soeDaily.min)
+	max.Set(state.soeDaily.max)
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	solarCapacityWatts = flag.Float64("solar.capacity-watts", 0, "Nameplate capacity of the solar array or inverter in watts. Enables tesla_powerwall_solar_capacity_factor when set.")
+
+	solarClippingThreshold = flag.Float64("solar.clipping-threshold", 0, "Fraction of -solar.capacity-watts at or above which solar production counts towards likely clipping, e.g. 0.97. 0 disables the check. Relies on per-target state; use background scraping for reliable results.")
+	solarClippingSamples   = flag.Int("solar.clipping-samples", 10, "Consecutive samples at or above -solar.clipping-threshold needed before flagging likely clipping.")
+)
+
+var solarCapacityFactorMetric = defineMetric(metricDef{
+	Name:      "solar_capacity_factor",
+	Type:      "gauge",
+	Unit:      "ratio",
+	Help:      "Solar instant power as a fraction of -solar.capacity-watts",
+	Collector: "meters",
+	Requires:  "-solar.capacity-watts",
+})
+
+var solarClippingLikelyMetric = defineMetric(metricDef{
+	Name:      "solar_clipping_likely",
+	Type:      "gauge",
+	Help:      "Whether solar production has been held at the inverter's capacity long enough that it is probably being clipped",
+	Collector: "meters",
+	Requires:  "-solar.clipping-threshold",
+})
+
+// maxCapacityFactor bounds the capacity factor so a glitchy reading can't
+// produce an absurd value. Arrays are often oversized relative to their
+// inverter, so a little above 1 is legitimate.
+const maxCapacityFactor = 1.2
+
+// populateSolarCapacityFactor exports solar production as a fraction of the
+// configured capacity.
+func populateSolarCapacityFactor(solar Record, reg *prometheus.Registry) error {
+	factor, err := solarCapacityFactorMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+	factor.Set(math.Max(0, math.Min(maxCapacityFactor, solar.InstantPower / *solarCapacityWatts)))
+
+	return nil
+}
+
+// populateSolarClipping flags production that has sat at the inverter's
+// limit for a sustained run of samples. Without irradiance data it can't
+// tell clipping from a day that happens to peak exactly at capacity, so it
+// waits for a long run before saying so.
+func populateSolarClipping(host string, solar Record, reg *prometheus.Registry) error {
+	clipping, err := solarClippingLikelyMetric.gauge(reg)
+	if err != nil {
+		return err
+	}
+
+	state := stateFor(host)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if solar.InstantPower >= *solarClippingThreshold*(*solarCapacityWatts) {
+		state.clippingSamples++
+	} else {
+		state.clippingSamples = 0
+	}
+
+	clipping.Set(boolToFloat(state.clippingSamples >= *solarClippingSamples))
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var sourceTimestamps = flag.Bool("metrics.source-timestamps", false, "Timestamp per-source meter metrics with the source's last_communication_time instead of leaving Prometheus to use the scrape time.")
+
+// timestampedCollector re-exposes the metrics gathered from inner, attaching
+// the measurement time of their source to every metric with a source label.
+// It is unchecked: the metrics it produces depend on what inner holds.
+type timestampedCollector struct {
+	inner prometheus.Gatherer
+	times map[string]time.Time
+}
+
+func (c timestampedCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c timestampedCollector) Collect(ch chan<- prometheus.Metric) {
+	families, err := c.inner.Gather()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(prometheus.NewDesc(Prefix+"_timestamped_metrics", "", nil, nil), err)
+		return
+	}
+
+	for _, mf := range families {
+		var valueType prometheus.ValueType
+		switch mf.GetType() {
+		case dto.MetricType_GAUGE:
+			valueType = prometheus.GaugeValue
+		case dto.MetricType_COUNTER:
+			valueType = prometheus.CounterValue
+		default:
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			var names, values []string
+			var source string
+			for _, l := range m.GetLabel() {
+				names = append(names, l.GetName())
+				values = append(values, l.GetValue())
+				if l.GetName() == "source" {
+					source = l.GetValue()
+				}
+			}
+
+			value := m.GetGauge().GetValue()
+			if valueType == prometheus.CounterValue {
+				value = m.GetCounter().GetValue()
+			}
+
+			desc := prometheus.NewDesc(mf.GetName(), mf.GetHelp(), names, nil)
+			metric, err := prometheus.NewConstMetric(desc, valueType, value, values...)
+			if err != nil {
+				ch <- prometheus.NewInvalidMetric(desc, err)
+				continue
+			}
+			if t, ok := c.times[source]; ok && !t.IsZero() {
+				metric = prometheus.NewMetricWithTimestamp(t, metric)
+			}
+			ch <- metric
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	startupVerify        = flag.Bool("startup.verify", false, "Exit with an error if the first background scrape of every target fails, so bad credentials or connectivity fail a rollout rather than looking healthy. Without it the results are only logged. Requires background scraping.")
+	startupVerifyTimeout = flag.Duration("startup.verify-timeout", time.Minute, "How long to wait for the first background scrape of each target when checking them at startup.")
+)
+
+// firstResults waits until every target has completed a background scrape,
+// or ctx is done, and returns each target's outcome. Targets that haven't
+// finished by then are reported as failed.
+func (s *backgroundScraper) firstResults(ctx context.Context) map[string]error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		s.mu.RLock()
+		done := true
+		for target := range s.targets {
+			if s.results[target] == nil {
+				done = false
+				break
+			}
+		}
+		if done || ctx.Err() != nil {
+			outcomes := map[string]error{}
+			for target := range s.targets {
+				if result := s.results[target]; result != nil {
+					outcomes[target] = result.err
+				} else {
+					outcomes[target] = errors.Errorf("no scrape completed within %s", *startupVerifyTimeout)
+				}
+			}
+			s.mu.RUnlock()
+			return outcomes
+		}
+		s.mu.RUnlock()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// verifyStartup logs the outcome of the first background scrape of every
+// target and reports whether any succeeded.
+func verifyStartup() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), *startupVerifyTimeout)
+	defer cancel()
+
+	outcomes := scraper.firstResults(ctx)
+	targets := make([]string, 0, len(outcomes))
+	for target := range outcomes {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	succeeded := 0
+	for _, target := range targets {
+		if err := outcomes[target]; err != nil {
+			slog.Warn("Startup check failed", "target", target, "reason", errorReason(err), "error", err)
+			continue
+		}
+		slog.Info("Startup check succeeded", "target", target)
+		succeeded++
+	}
+	slog.Info("Startup check finished", "succeeded", succeeded, "targets", len(targets))
+
+	return succeeded > 0
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// targetState holds everything the exporter remembers about a gateway
+// between scrapes. Metrics derived from it are only as good as the sampling
+// that feeds it, which is why stateful metrics work best with background
+// scraping (see -scrape.targets).
+//
+// Probes, background scrapes and the /metrics collectors may all touch the
+// same target's state at once, so every field is guarded by mu. Each scrape
+// still builds its own registry; only what outlives a scrape lives here.
+// mu is held only while reading or updating fields, never across a request
+// to the gateway, so a slow gateway can't stall other scrapes of it.
+type targetState struct {
+	mu sync.Mutex
+
+	location    *time.Location
+	energyToday *dailyEnergy
+	soeDaily    *dailyRange
+
+	// siteInfo is the last /api/site_info response, fetched at
+	// siteInfoTime.
+	siteInfo     *SiteInfo
+	siteInfoTime time.Time
+
+	// slowCollections holds the last result of each slow collector, for
+	// -scrape.slow-interval.
+	slowCollections map[string]cachedCollection
+
+	// batteryDirection is the last direction the battery was seen moving
+	// in and batteryTransitions the number of changes, for
+	// -metrics.battery-transitions.
+	batteryDirection   int
+	batteryTransitions float64
+
+	// clippingSamples counts consecutive samples with solar production at
+	// the inverter's limit, for -solar.clipping-threshold.
+	clippingSamples int
+
+	// operationMode is the last operation mode seen and
+	// operationModeChanges the number of times it has changed.
+	operationMode        string
+	operationModeChanges float64
+
+	// gridTransitionReason is the latest reason the gateway gave for a
+	// grid state change.
+	gridTransitionReason string
+
+	// negativeSolarSamples counts consecutive daylight samples with
+	// negative solar production, for -ct-check.enabled.
+	negativeSolarSamples int
+
+	// consecutiveFailures and consecutiveSuccesses are the current run of
+	// failed or successful scrapes.
+	consecutiveFailures  int
+	consecutiveSuccesses int
+
+	// soeOutOfRange is whether the last battery percentage was outside
+	// 0-100, for -soe.clamp.
+	soeOutOfRange bool
+
+	// powerWindows summarises each source's instant power since the last
+	// probe, for -metrics.power-window.
+	powerWindows map[string]*powerWindow
+
+	// lastScrape is when the target was last scraped, for
+	// -auth.keepalive-interval.
+	lastScrape time.Time
+
+	// capabilities is what was last detected about the target, for
+	// -capabilities.recheck-interval.
+	capabilities *capabilitySnapshot
+
+	// clockOffset is how far the gateway's clock is ahead of ours, if
+	// clockOffsetKnown, for -staleness.clock.
+	clockOffset      time.Duration
+	clockOffsetKnown bool
+
+	// loadSamples are the home load readings within -backup.load-window.
+	loadSamples []loadSample
+
+	// cloudComparison is the last comparison of cloud and local values,
+	// for -collect.cloud_compare.
+	cloudComparison *cloudComparison
+}
+
+var (
+	statesMu sync.Mutex
+	states   = map[string]*targetState{}
+)
+
+// stateFor returns the state for target, creating it on first use.
+func stateFor(target string) *targetState {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+
+	s, ok := states[target]
+	if !ok {
+		s = &targetState{}
+		states[target] = s
+	}
+	return s
+}
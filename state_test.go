@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestConcurrentProbes probes one target from many goroutines with the
+// stateful metrics enabled, while the exporter's own metrics and new
+// targets touch the state map. Run it with -race.
+func TestConcurrentProbes(t *testing.T) {
+	setFlag(t, derivedMetrics, true)
+	setFlag(t, energyToday, true)
+	setFlag(t, soeDaily, true)
+	setFlag(t, ctCheck, true)
+	setFlag(t, batteryTransitions, true)
+	setFlag(t, scrapeSlowInterval, time.Minute)
+
+	gw := newMockGateway(t, "23.44.0")
+	query := url.Values{"target": {gw.target()}, "collect": {"meters,soe,operation,system_status"}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if rec := probe(t, query); rec.Code != http.StatusOK {
+					t.Errorf("probe answered %d: %s", rec.Code, rec.Body.String())
+				}
+			}
+		}()
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 20; j++ {
+			if _, err := prometheus.DefaultGatherer.Gather(); err != nil {
+				t.Errorf("gathering exporter metrics failed: %v", err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 20; j++ {
+			target := fmt.Sprintf("192.0.2.%d", j)
+			stateFor(target)
+			forgetTarget(target)
+		}
+	}()
+	wg.Wait()
+}
+
+// TestTimezoneLookupUnlocked checks that the target's state lock isn't
+// held while the gateway is asked for its timezone.
+func TestTimezoneLookupUnlocked(t *testing.T) {
+	gw := newMockGateway(t, "23.44.0")
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	gw.set("/api/site_info", mockResponse{handler: func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"timezone":"Australia/Sydney"}`))
+	}})
+
+	done := make(chan *time.Location)
+	go func() { done <- timezone(context.Background(), gw.target()) }()
+
+	<-entered
+	state := stateFor(gw.target())
+	locked := state.mu.TryLock()
+	if locked {
+		state.mu.Unlock()
+	}
+	close(release)
+
+	if !locked {
+		t.Error("state lock held while querying the gateway's timezone")
+	}
+	if loc := <-done; loc.String() != "Australia/Sydney" {
+		t.Errorf("timezone = %v, want Australia/Sydney", loc)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var webStream = flag.Bool("web.stream", false, "Serve /stream, a Server-Sent Events feed of every background scrape result. Requires background scraping.")
+
+// streamKeepAlive is how often an idle stream gets a comment line, so
+// proxies don't close it.
+const streamKeepAlive = 15 * time.Second
+
+// streamSample is one metric value in a stream event.
+type streamSample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// streamEvent is the data of each event sent on /stream.
+type streamEvent struct {
+	Target  string         `json:"target"`
+	Time    time.Time      `json:"time"`
+	Samples []streamSample `json:"samples"`
+}
+
+// newStreamEvent flattens a scrape result into a stream event.
+func newStreamEvent(target string, ts time.Time, families []*dto.MetricFamily) *streamEvent {
+	ev := &streamEvent{Target: target, Time: ts}
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			var value float64
+			switch {
+			case m.Gauge != nil:
+				value = m.GetGauge().GetValue()
+			case m.Counter != nil:
+				value = m.GetCounter().GetValue()
+			case m.Untyped != nil:
+				value = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+
+			sample := streamSample{Name: mf.GetName(), Value: value}
+			if len(m.GetLabel()) > 0 {
+				sample.Labels = map[string]string{}
+				for _, l := range m.GetLabel() {
+					sample.Labels[l.GetName()] = l.GetValue()
+				}
+			}
+			ev.Samples = append(ev.Samples, sample)
+		}
+	}
+	return ev
+}
+
+// streamBroker fans background scrape results out to /stream clients.
+type streamBroker struct {
+	mu   sync.Mutex
+	subs map[chan *streamEvent]string
+
+	// done is closed on shutdown, ending every stream.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// broker is the stream broker, or nil when -web.stream is unset.
+var broker *streamBroker
+
+func newStreamBroker() *streamBroker {
+	return &streamBroker{
+		subs: map[chan *streamEvent]string{},
+		done: make(chan struct{}),
+	}
+}
+
+// close ends every open stream, so a graceful shutdown doesn't wait for
+// clients that would otherwise stay connected forever.
+func (b *streamBroker) close() {
+	b.closeOnce.Do(func() { close(b.done) })
+}
+
+// subscribe registers a client for events about target, or every target
+// if it is empty.
+func (b *streamBroker) subscribe(target string) chan *streamEvent {
+	// Each client holds at most one pending event, so a slow client only
+	// ever falls behind to the latest reading rather than queueing.
+	ch := make(chan *streamEvent, 1)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[ch] = target
+	return ch
+}
+
+func (b *streamBroker) unsubscribe(ch chan *streamEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, ch)
+}
+
+// publish sends ev to every interested client without blocking, replacing
+// any event a client hasn't picked up yet.
+func (b *streamBroker) publish(ev *streamEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch, target := range b.subs {
+		if target != "" && target != ev.Target {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+			select {
+			case ch <- ev:
+			default:
+			}
+		}
+	}
+}
+
+// serveStream streams events as Server-Sent Events until the client goes
+// away or the exporter shuts down. ?target= limits the stream to one
+// gateway, and is normalized like a probe's.
+func (b *streamBroker) serveStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported by this connection.", http.StatusInternalServerError)
+		return
+	}
+
+	ch := b.subscribe(normalizeTarget(r.URL.Query().Get("target")))
+	defer b.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case ev := <-ch:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				slog.Error("Encoding stream event failed", "target", ev.Target, "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: reading\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-b.done:
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openStream connects to b's /stream with query and returns the response
+// once its headers are in.
+func openStream(t *testing.T, b *streamBroker, query string) (*http.Response, *httptest.Server) {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(b.serveStream))
+	srv.Config.RegisterOnShutdown(b.close)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL + "/stream" + query)
+	if err != nil {
+		t.Fatalf("opening stream: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp, srv
+}
+
+func TestStreamTargetNormalized(t *testing.T) {
+	b := newStreamBroker()
+	resp, _ := openStream(t, b, "?target=https://192.168.1.50/")
+
+	b.publish(&streamEvent{Target: "192.168.1.51"})
+	b.publish(&streamEvent{Target: "192.168.1.50"})
+
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() {
+		line := lines.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		if !strings.Contains(line, `"target":"192.168.1.50"`) {
+			t.Errorf("stream for https://192.168.1.50/ sent %s", line)
+		}
+		return
+	}
+	t.Fatalf("stream ended without an event: %v", lines.Err())
+}
+
+func TestStreamClosedOnShutdown(t *testing.T) {
+	b := newStreamBroker()
+	resp, srv := openStream(t, b, "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Config.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() failed with a stream open: %v", err)
+	}
+
+	if _, err := bufio.NewReader(resp.Body).ReadString(0); err == nil {
+		t.Error("stream still open after shutdown")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	validityMaxPower        = flag.Float64("validity.max-power-watts", 1000000, "Instant power magnitude above which a source's reading is considered implausible.")
+	validityMinVoltage      = flag.Float64("validity.min-voltage", 0, "Voltage below which a reading with significant power is considered implausible. 0 disables the check.")
+	validityMinVoltagePower = flag.Float64("validity.min-voltage-power-watts", 1000, "Instant power magnitude above which -validity.min-voltage is enforced.")
+)
+
+var readingValidMetric = defineMetric(metricDef{
+	Name:      "reading_valid",
+	Type:      "gauge",
+	Help:      "Whether the source's reading passed the -validity.* sanity checks",
+	Labels:    []string{"source"},
+	Collector: "meters",
+})
+
+// readingValid reports whether rec looks physically plausible. The gateway
+// occasionally returns garbage samples, such as huge power spikes or high
+// power at zero volts, which this lets users filter out.
+func readingValid(rec Record) bool {
+	power := math.Abs(rec.InstantPower)
+	if power > *validityMaxPower {
+		return false
+	}
+	if *validityMinVoltage > 0 && power > *validityMinVoltagePower && rec.InstantAverageVoltage < *validityMinVoltage {
+		return false
+	}
+	return true
+}
+
+func populateReadingValid(source string, rec Record, reg *prometheus.Registry) error {
+	valid, err := readingValidMetric.gaugeVec(reg)
+	if err != nil {
+		return err
+	}
+	valid.WithLabelValues(source).Set(boolToFloat(readingValid(rec)))
+
+	return nil
+}